@@ -0,0 +1,144 @@
+package infra
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
+	log "github.com/sirupsen/logrus"
+)
+
+// AccessLogConfig 访问日志的配置
+type AccessLogConfig struct {
+	// 成功请求的采样比例，0到1，失败的请求都会记录
+	SampleRatio float64
+	// 可信的代理，ip或者CIDR，请求来自可信代理时从X-Forwarded-For中取客户端ip
+	TrustedProxies []string
+	// 默认写到 /logs/<程序名>.access.%Y%m%d.log
+	Output io.Writer
+}
+
+type accessLog struct {
+	logger      *log.Logger
+	sampleRatio float64
+	trusted     []*net.IPNet
+}
+
+// EnableAccessLog 开启访问日志，每个请求一行json，和应用日志分开写到单独的文件
+func (h *httpMonitor) EnableAccessLog(cfg AccessLogConfig) error {
+	trusted, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	out := cfg.Output
+	if out == nil {
+		out, err = rotatelogs.New(
+			"/logs/"+filepath.Base(os.Args[0])+".access.%Y%m%d.log",
+			rotatelogs.WithMaxAge(time.Hour*24*3),
+			rotatelogs.WithRotationTime(24*time.Hour),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	logger := log.New()
+	logger.SetFormatter(&log.JSONFormatter{
+		TimestampFormat: "2006-01-02T15:04:05.999Z",
+	})
+	logger.SetOutput(out)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.accessLog = &accessLog{logger: logger, sampleRatio: cfg.SampleRatio, trusted: trusted}
+	return nil
+}
+
+func (h *httpMonitor) getAccessLog() *accessLog {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.accessLog
+}
+
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func (a *accessLog) isTrusted(ip net.IP) bool {
+	for _, n := range a.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP 请求来自可信代理时，从右往左取X-Forwarded-For中第一个不可信的地址
+func (a *accessLog) clientIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	ip := net.ParseIP(remote)
+	if ip == nil || !a.isTrusted(ip) {
+		return remote
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		hop := net.ParseIP(addr)
+		if hop == nil {
+			break
+		}
+		if !a.isTrusted(hop) {
+			return addr
+		}
+		remote = addr
+	}
+	return remote
+}
+
+func (a *accessLog) sampled(status int) bool {
+	if status >= http.StatusBadRequest || a.sampleRatio >= 1 {
+		return true
+	}
+	return rand.Float64() < a.sampleRatio
+}
+
+func (a *accessLog) record(r *http.Request, api string, status int, cost time.Duration, reqSize int64, respSize int64) {
+	if !a.sampled(status) {
+		return
+	}
+	data := log.Fields{
+		"method":    r.Method,
+		"route":     api,
+		"path":      r.URL.Path,
+		"status":    status,
+		Cost:        cost.Milliseconds(),
+		"reqBytes":  reqSize,
+		"respBytes": respSize,
+		"clientIp":  a.clientIP(r),
+		"userAgent": r.UserAgent(),
+		"uid":       requestUID(r.Context()),
+	}
+	a.logger.WithFields(withRequestFields(r.Context(), data)).Info("access")
+}
@@ -0,0 +1,68 @@
+package infra
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	if err := HttpMonitor.EnableAccessLog(AccessLogConfig{SampleRatio: 0, TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}, Output: &buf}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		HttpMonitor.mu.Lock()
+		HttpMonitor.accessLog = nil
+		HttpMonitor.mu.Unlock()
+	}()
+	handler := MetricMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetRequestUID(r.Context(), "u42")
+		if r.URL.Path == "/access/ok" {
+			w.Write([]byte("ok"))
+			return
+		}
+		http.Error(w, "bad", http.StatusBadRequest)
+	}))
+	// 采样比例为0，成功的请求不记录
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/access/ok", nil))
+	if buf.Len() != 0 {
+		t.Fatalf("sampled out request logged: %s", buf.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/access/7", strings.NewReader("body"))
+	req.RemoteAddr = "10.1.2.3:5555"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8, 192.168.1.1")
+	req.Header.Set("User-Agent", "test-agent")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &entry); err != nil {
+		t.Fatalf("access log is not one json line: %v %q", err, buf.String())
+	}
+	want := map[string]interface{}{
+		"method": "POST", "route": "/access/:id", "path": "/access/7", "status": float64(400),
+		"reqBytes": float64(4), "respBytes": float64(4), "clientIp": "5.6.7.8", "userAgent": "test-agent", "uid": "u42",
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("%s = %v, want %v", k, entry[k], v)
+		}
+	}
+	if id, _ := entry[TraceIDField].(string); len(id) != 32 {
+		t.Errorf("trace_id = %v", entry[TraceIDField])
+	}
+}
+
+func TestClientIPUntrustedRemote(t *testing.T) {
+	a := &accessLog{}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "8.8.8.8:1234"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	if got := a.clientIP(req); got != "8.8.8.8" {
+		t.Errorf("clientIP = %s, want remote address when proxy is not trusted", got)
+	}
+}
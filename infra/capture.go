@@ -0,0 +1,220 @@
+package infra
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const redacted = "[REDACTED]"
+
+// RequestCaptureConfig 控制MetricMiddleware对失败或者慢请求的记录方式
+type RequestCaptureConfig struct {
+	// body最多记录的字节数
+	MaxBodyBytes int
+	// 超过该耗时的请求也会记录
+	SlowThreshold time.Duration
+	// 需要脱敏的header
+	RedactHeaders []string
+	// 需要脱敏的json字段，同时作用于表单字段和URL参数
+	RedactJSONFields []string
+	// 只记录这些Content-Type前缀的body，其余视为二进制
+	ContentTypes []string
+}
+
+var defaultRequestCaptureConfig = RequestCaptureConfig{
+	MaxBodyBytes:     4096,
+	SlowThreshold:    time.Second,
+	RedactHeaders:    []string{"Authorization", "Cookie", "Proxy-Authorization", "X-Api-Key"},
+	RedactJSONFields: []string{"password", "token", "secret"},
+	ContentTypes:     []string{"application/json", "application/x-www-form-urlencoded", "application/xml", "text/"},
+}
+
+type requestCapture struct {
+	RequestCaptureConfig
+	jsonRedactor *regexp.Regexp
+	formRedactor *regexp.Regexp
+}
+
+func newRequestCapture(cfg RequestCaptureConfig) *requestCapture {
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = defaultRequestCaptureConfig.MaxBodyBytes
+	}
+	if cfg.SlowThreshold <= 0 {
+		cfg.SlowThreshold = defaultRequestCaptureConfig.SlowThreshold
+	}
+	c := &requestCapture{RequestCaptureConfig: cfg}
+	if len(cfg.RedactJSONFields) > 0 {
+		fields := make([]string, 0, len(cfg.RedactJSONFields))
+		for _, f := range cfg.RedactJSONFields {
+			fields = append(fields, regexp.QuoteMeta(f))
+		}
+		names := strings.Join(fields, "|")
+		c.jsonRedactor = regexp.MustCompile(`(?i)"(?:` + names + `)"\s*:\s*`)
+		c.formRedactor = regexp.MustCompile(`(?i)((?:^|&)(?:` + names + `)=)[^&]*`)
+	}
+	return c
+}
+
+// SetRequestCapture 设置失败或慢请求的记录方式
+func (h *httpMonitor) SetRequestCapture(cfg RequestCaptureConfig) {
+	c := newRequestCapture(cfg)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.capture = c
+}
+
+func (h *httpMonitor) requestCapture() *requestCapture {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.capture
+}
+
+// capturesContentType 是否记录该Content-Type的body
+func (c *requestCapture) capturesContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	for _, t := range c.ContentTypes {
+		if strings.HasPrefix(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// captureBody 在handler读取body时最多保留max字节，不会提前把body读进内存
+type captureBody struct {
+	io.ReadCloser
+	max       int
+	capture   bool
+	buf       bytes.Buffer
+	read      int64
+	truncated bool
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.capture && n > 0 {
+		remain := b.max - b.buf.Len()
+		if remain > n {
+			remain = n
+		}
+		if remain > 0 {
+			b.buf.Write(p[:remain])
+		}
+		if remain < n {
+			b.truncated = true
+		}
+	}
+	return n, err
+}
+
+// dump 生成和httputil.DumpRequest格式类似的请求内容，header和body已脱敏
+func (c *requestCapture) dump(r *http.Request, body *captureBody) string {
+	var buf bytes.Buffer
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	if i := strings.IndexByte(uri, '?'); i >= 0 && c.formRedactor != nil {
+		uri = uri[:i+1] + c.formRedactor.ReplaceAllString(uri[i+1:], "${1}"+redacted)
+	}
+	fmt.Fprintf(&buf, "%s %s %s\r\n", r.Method, uri, r.Proto)
+	fmt.Fprintf(&buf, "Host: %s\r\n", r.Host)
+	header := r.Header.Clone()
+	for _, name := range c.RedactHeaders {
+		if header.Get(name) != "" {
+			header.Set(name, redacted)
+		}
+	}
+	header.Write(&buf)
+	buf.WriteString("\r\n")
+	contentType := r.Header.Get("Content-Type")
+	switch {
+	case !body.capture:
+		if body.read > 0 {
+			fmt.Fprintf(&buf, "[binary body omitted, %d bytes, Content-Type: %s]", body.read, contentType)
+		}
+	default:
+		buf.WriteString(c.redactBody(contentType, body.buf.String()))
+		if body.truncated {
+			fmt.Fprintf(&buf, "...[truncated, %d bytes read]", body.read)
+		}
+	}
+	return buf.String()
+}
+
+func (c *requestCapture) redactBody(contentType string, body string) string {
+	if c.jsonRedactor == nil {
+		return body
+	}
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		return c.formRedactor.ReplaceAllString(body, "${1}"+redacted)
+	}
+	return c.redactJSON(body)
+}
+
+// redactJSON 把匹配字段的整个值替换掉，值可以是字符串、数字或者嵌套的对象和数组，body被截断时替换到结尾
+func (c *requestCapture) redactJSON(body string) string {
+	var buf strings.Builder
+	last := 0
+	for _, m := range c.jsonRedactor.FindAllStringIndex(body, -1) {
+		if m[0] < last {
+			// 在已经脱敏的值里面
+			continue
+		}
+		buf.WriteString(body[last:m[1]])
+		buf.WriteString(`"` + redacted + `"`)
+		last = jsonValueEnd(body, m[1])
+	}
+	buf.WriteString(body[last:])
+	return buf.String()
+}
+
+// jsonValueEnd 返回从start开始的json值的结束位置
+func jsonValueEnd(s string, start int) int {
+	depth := 0
+	inString := false
+	for i := start; i < len(s); i++ {
+		ch := s[i]
+		if inString {
+			switch ch {
+			case '\\':
+				i++
+			case '"':
+				inString = false
+				if depth == 0 {
+					return i + 1
+				}
+			}
+			continue
+		}
+		switch ch {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth == 0 {
+				return i
+			}
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		case ',', ' ', '\t', '\r', '\n':
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(s)
+}
@@ -0,0 +1,79 @@
+package infra
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestCaptureRedactsAndTruncates(t *testing.T) {
+	c := newRequestCapture(RequestCaptureConfig{
+		MaxBodyBytes:     40,
+		RedactHeaders:    []string{"Authorization"},
+		RedactJSONFields: []string{"password"},
+		ContentTypes:     []string{"application/json"},
+	})
+	r := httptest.NewRequest("POST", "/login?x=1", strings.NewReader(`{"user":"a","password":"p\"w","note":"0123456789abcdef"}`))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r.Header.Set("Authorization", "Bearer secret")
+	body := &captureBody{ReadCloser: r.Body, max: c.MaxBodyBytes, capture: c.capturesContentType(r.Header.Get("Content-Type"))}
+	if _, err := io.ReadAll(body); err != nil {
+		t.Fatal(err)
+	}
+	dump := c.dump(r, body)
+	if strings.Contains(dump, "Bearer secret") || strings.Contains(dump, `p\"w`) {
+		t.Fatalf("dump not redacted: %q", dump)
+	}
+	if !strings.HasPrefix(dump, "POST /login?x=1 HTTP/1.1\r\n") || !strings.Contains(dump, "Authorization: "+redacted) {
+		t.Fatalf("unexpected dump: %q", dump)
+	}
+	if !strings.Contains(dump, `"password":"`+redacted+`"`) || !strings.Contains(dump, "[truncated, 56 bytes read]") {
+		t.Fatalf("unexpected body: %q", dump)
+	}
+}
+
+func TestRequestCaptureSkipsBinary(t *testing.T) {
+	c := newRequestCapture(defaultRequestCaptureConfig)
+	r := httptest.NewRequest("PUT", "/upload", strings.NewReader(strings.Repeat("x", 10000)))
+	r.Header.Set("Content-Type", "image/png")
+	body := &captureBody{ReadCloser: r.Body, max: c.MaxBodyBytes, capture: c.capturesContentType(r.Header.Get("Content-Type"))}
+	io.Copy(io.Discard, body)
+	if body.buf.Len() != 0 {
+		t.Fatalf("binary body buffered: %d bytes", body.buf.Len())
+	}
+	if dump := c.dump(r, body); !strings.Contains(dump, "[binary body omitted, 10000 bytes, Content-Type: image/png]") {
+		t.Fatalf("unexpected dump: %q", dump)
+	}
+}
+
+func TestRequestCaptureRedactsNestedAndQuery(t *testing.T) {
+	c := newRequestCapture(RequestCaptureConfig{
+		RedactHeaders:    []string{"Authorization"},
+		RedactJSONFields: []string{"password", "token"},
+		ContentTypes:     []string{"application/json"},
+	})
+	cases := []struct {
+		body string
+		want string
+	}{
+		{`{"token":{"access":"a1","refresh":["r1","r2"]},"user":"u"}`, `{"token":"[REDACTED]","user":"u"}`},
+		{`{"password":["p1",{"x":"}"}],"n":1}`, `{"password":"[REDACTED]","n":1}`},
+		{`{"password": 123456 , "token" :null}`, `{"password": "[REDACTED]" , "token" :"[REDACTED]"}`},
+		{`{"a":{"Token":"t","b":2}}`, `{"a":{"Token":"[REDACTED]","b":2}}`},
+		// 截断的body替换到结尾
+		{`{"token":{"access":"a1","refr`, `{"token":"[REDACTED]"`},
+	}
+	for _, tc := range cases {
+		if got := c.redactBody("application/json", tc.body); got != tc.want {
+			t.Errorf("redactBody(%s) = %s, want %s", tc.body, got, tc.want)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/reset?user=a&token=abc&Password=p%26w&page=2", nil)
+	body := &captureBody{ReadCloser: r.Body, max: c.MaxBodyBytes}
+	dump := c.dump(r, body)
+	if !strings.HasPrefix(dump, "GET /reset?user=a&token=[REDACTED]&Password=[REDACTED]&page=2 HTTP/1.1\r\n") {
+		t.Errorf("query not redacted: %q", dump)
+	}
+}
@@ -0,0 +1,21 @@
+// Package chiadapter 让chi路由使用infra的监控，api标签是chi的路由模板，比如 /users/{id}
+package chiadapter
+
+import (
+	"net/http"
+
+	"easymonitor/infra"
+	"github.com/go-chi/chi/v5"
+)
+
+// Middleware 通过 router.Use(chiadapter.Middleware) 使用
+func Middleware(next http.Handler) http.Handler {
+	return infra.RouteMiddleware(routePattern)(next)
+}
+
+func routePattern(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		return rctx.RoutePattern()
+	}
+	return ""
+}
@@ -0,0 +1,21 @@
+package chiadapter
+
+import (
+	"testing"
+
+	"easymonitor/infra"
+	"easymonitor/infra/internal/adaptertest"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestChiSeries(t *testing.T) {
+	baseline := adaptertest.NetHTTPBaseline(t, "/chi-nethttp")
+	otherBefore := adaptertest.Series(t, infra.OtherAPI)["GET 404"]
+
+	router := chi.NewRouter()
+	router.Use(Middleware)
+	router.HandleFunc("/chi/users/{id}", adaptertest.Respond)
+	adaptertest.Serve(router, "/chi")
+
+	adaptertest.AssertSameSeries(t, "/chi/users/{id}", baseline, otherBefore)
+}
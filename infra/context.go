@@ -0,0 +1,59 @@
+package infra
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+const UIDField = "uid"
+
+type ctxKeyRequestState struct{}
+
+// requestState 保存一次请求内各个hook之间需要共享的信息，由MetricMiddleware放入请求的context
+type requestState struct {
+	mu          sync.Mutex
+	stampedeID  string
+	stampedeKey string
+	uid         string
+}
+
+func withRequestState(ctx context.Context) context.Context {
+	if requestStateFrom(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKeyRequestState{}, &requestState{})
+}
+
+func requestStateFrom(ctx context.Context) *requestState {
+	if ctx == nil {
+		return nil
+	}
+	state, _ := ctx.Value(ctxKeyRequestState{}).(*requestState)
+	return state
+}
+
+func (s *requestState) markStampede(id string, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stampedeID = id
+	s.stampedeKey = key
+}
+
+func (s *requestState) stampede() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stampedeID, s.stampedeKey
+}
+
+// withRequestFields 把ctx中的trace_id、span_id和uid加入日志字段
+func withRequestFields(ctx context.Context, data log.Fields) log.Fields {
+	if t, ok := TraceFromContext(ctx); ok {
+		data[TraceIDField] = t.TraceID
+		data[SpanIDField] = t.SpanID
+	}
+	if uid := requestUID(ctx); uid != "" {
+		data[UIDField] = uid
+	}
+	return data
+}
@@ -0,0 +1,45 @@
+// Package echoadapter 让echo使用infra的监控，api标签是echo的路由模板，比如 /users/:id
+package echoadapter
+
+import (
+	"net/http"
+
+	"easymonitor/infra"
+	"github.com/labstack/echo/v4"
+)
+
+// Middleware 通过 e.Use(echoadapter.Middleware()) 使用，需要放在其它中间件前面
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			infra.ServeInstrumented(c.Response(), c.Request(), echoState{c}, func(r *http.Request) {
+				c.SetRequest(r)
+				// handler返回的错误由echo写成响应，之后才能拿到状态码
+				if err := next(c); err != nil {
+					c.Error(err)
+				}
+			})
+			return nil
+		}
+	}
+}
+
+type echoState struct {
+	c echo.Context
+}
+
+func (s echoState) Route() string {
+	return s.c.Path()
+}
+
+func (s echoState) Status() int {
+	return s.c.Response().Status
+}
+
+func (s echoState) Written() int64 {
+	return s.c.Response().Size
+}
+
+func (s echoState) Committed() bool {
+	return s.c.Response().Committed
+}
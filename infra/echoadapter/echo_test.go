@@ -0,0 +1,26 @@
+package echoadapter
+
+import (
+	"testing"
+
+	"easymonitor/infra"
+	"easymonitor/infra/internal/adaptertest"
+	"github.com/labstack/echo/v4"
+)
+
+func TestEchoSeries(t *testing.T) {
+	baseline := adaptertest.NetHTTPBaseline(t, "/echo-nethttp")
+	otherBefore := adaptertest.Series(t, infra.OtherAPI)["GET 404"]
+
+	e := echo.New()
+	e.Use(Middleware())
+	handler := func(c echo.Context) error {
+		adaptertest.Respond(c.Response(), c.Request())
+		return nil
+	}
+	e.GET("/echo/users/:id", handler)
+	e.POST("/echo/users/:id", handler)
+	adaptertest.Serve(e, "/echo")
+
+	adaptertest.AssertSameSeries(t, "/echo/users/:id", baseline, otherBefore)
+}
@@ -0,0 +1,132 @@
+// Package fasthttpadapter 让fasthttp使用infra的监控，fasthttp没有自带路由，路由模板由调用方提供
+package fasthttpadapter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+
+	"easymonitor/infra"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+// requestContextKey 保存带有trace、uid等信息的context
+const requestContextKey = "easymonitor.requestContext"
+
+// RouteFunc 在handler执行之后返回路由模板，返回空时按path归一化
+type RouteFunc func(ctx *fasthttp.RequestCtx) string
+
+// UserValueRoute 从ctx.UserValue中取路由模板，比如fasthttp/router开启SaveMatchedRoutePath之后的 router.MatchedRoutePathParam
+func UserValueRoute(key string) RouteFunc {
+	return func(ctx *fasthttp.RequestCtx) string {
+		route, _ := ctx.UserValue(key).(string)
+		return route
+	}
+}
+
+// Middleware 包装fasthttp的handler，route可以为空
+func Middleware(next fasthttp.RequestHandler, route RouteFunc) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		r := &http.Request{}
+		// route被所有请求共享，只能在这次请求里替换
+		reqRoute := route
+		if err := fasthttpadaptor.ConvertRequest(ctx, r, true); err != nil {
+			// 请求的uri解析失败时仍然记录指标和恢复panic，api统一为other
+			r = fallbackRequest(ctx)
+			reqRoute = otherRoute
+		}
+		w := &responseWriter{ctx: ctx, header: http.Header{}}
+		infra.ServeInstrumented(w, r, &state{ctx: ctx, route: reqRoute}, func(r *http.Request) {
+			// fasthttp已经把body读进内存，这里读一遍让失败请求的日志里有body
+			io.Copy(io.Discard, r.Body)
+			ctx.SetUserValue(requestContextKey, r.Context())
+			next(ctx)
+		})
+	}
+}
+
+func otherRoute(*fasthttp.RequestCtx) string {
+	return infra.OtherAPI
+}
+
+// fallbackRequest 在ConvertRequest失败时只保留记录指标和日志需要的字段
+func fallbackRequest(ctx *fasthttp.RequestCtx) *http.Request {
+	header := http.Header{}
+	ctx.Request.Header.VisitAll(func(k, v []byte) {
+		header.Add(string(k), string(v))
+	})
+	return &http.Request{
+		Method:     string(ctx.Method()),
+		URL:        &url.URL{Path: string(ctx.Path())},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       http.NoBody,
+		Host:       string(ctx.Host()),
+		RemoteAddr: ctx.RemoteAddr().String(),
+	}
+}
+
+// Context 返回请求的context，传给RedisMonitor.WithContext和database/sql，日志才能带上trace_id和uid
+func Context(ctx *fasthttp.RequestCtx) context.Context {
+	if c, ok := ctx.UserValue(requestContextKey).(context.Context); ok {
+		return c
+	}
+	return ctx
+}
+
+type state struct {
+	ctx   *fasthttp.RequestCtx
+	route RouteFunc
+}
+
+func (s *state) Route() string {
+	if s.route == nil {
+		return ""
+	}
+	return s.route(s.ctx)
+}
+
+func (s *state) Status() int {
+	return s.ctx.Response.StatusCode()
+}
+
+func (s *state) Written() int64 {
+	return int64(len(s.ctx.Response.Body()))
+}
+
+// Committed fasthttp在handler返回之后才发送响应，总是可以改写
+func (s *state) Committed() bool {
+	return false
+}
+
+// responseWriter 只用于infra写限流的503和panic的500
+type responseWriter struct {
+	ctx    *fasthttp.RequestCtx
+	header http.Header
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(statusCode int) {
+	w.ctx.Response.ResetBody()
+	for k, values := range w.header {
+		for i, v := range values {
+			if i == 0 {
+				w.ctx.Response.Header.Set(k, v)
+			} else {
+				w.ctx.Response.Header.Add(k, v)
+			}
+		}
+	}
+	w.ctx.SetStatusCode(statusCode)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	return w.ctx.Write(b)
+}
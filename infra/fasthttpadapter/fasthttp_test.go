@@ -0,0 +1,91 @@
+package fasthttpadapter
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"easymonitor/infra"
+	"easymonitor/infra/internal/adaptertest"
+	"github.com/valyala/fasthttp"
+)
+
+func TestFasthttpSeries(t *testing.T) {
+	baseline := adaptertest.NetHTTPBaseline(t, "/fast-nethttp")
+	otherBefore := adaptertest.Series(t, infra.OtherAPI)["GET 404"]
+
+	const route = "/fast/users/{id}"
+	var traced bool
+	handler := Middleware(func(ctx *fasthttp.RequestCtx) {
+		if !strings.HasPrefix(string(ctx.Path()), "/fast/users/") {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			return
+		}
+		ctx.SetUserValue("route", route)
+		_, traced = infra.TraceFromContext(Context(ctx))
+		if ctx.QueryArgs().Has("panic") {
+			panic("boom")
+		}
+		if ctx.IsPost() {
+			ctx.SetStatusCode(fasthttp.StatusCreated)
+		}
+		ctx.WriteString("ok")
+	}, UserValueRoute("route"))
+
+	for _, c := range append(adaptertest.Calls, adaptertest.NotFound) {
+		req := &fasthttp.Request{}
+		req.Header.SetMethod(c.Method)
+		req.SetRequestURI("http://example.com/fast" + c.Path)
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(req, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, nil)
+		handler(ctx)
+		if strings.Contains(c.Path, "panic") && ctx.Response.StatusCode() != fasthttp.StatusInternalServerError {
+			t.Errorf("panic status = %d, want 500", ctx.Response.StatusCode())
+		}
+	}
+
+	adaptertest.AssertSameSeries(t, route, baseline, otherBefore)
+	if !traced {
+		t.Error("handler context has no trace")
+	}
+}
+
+func TestFasthttpInvalidURIStillInstrumented(t *testing.T) {
+	const route = "/fast-bad/users/{id}"
+	before := adaptertest.Series(t, infra.OtherAPI)["GET 500"]
+	handler := Middleware(func(ctx *fasthttp.RequestCtx) {
+		ctx.SetUserValue("route", route)
+		if strings.HasPrefix(string(ctx.Path()), "/bad/") {
+			panic("boom")
+		}
+		ctx.WriteString("ok")
+	}, UserValueRoute("route"))
+
+	serve := func(uri string) *fasthttp.RequestCtx {
+		req := &fasthttp.Request{}
+		req.Header.SetMethod(fasthttp.MethodGet)
+		req.SetRequestURI(uri)
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(req, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, nil)
+		handler(ctx)
+		return ctx
+	}
+
+	if ctx := serve("/bad/%zz"); ctx.Response.StatusCode() != fasthttp.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", ctx.Response.StatusCode())
+	}
+	if got := adaptertest.Series(t, infra.OtherAPI)["GET 500"]; got != before+1 {
+		t.Errorf("other GET 500 = %v, want %v", got, before+1)
+	}
+
+	// 同一个handler后面的正常请求仍然按自己的路由记录
+	otherOK := adaptertest.Series(t, infra.OtherAPI)["GET 200"]
+	routeOK := adaptertest.Series(t, route)["GET 200"]
+	serve("/fast-bad/users/1")
+	if got := adaptertest.Series(t, route)["GET 200"]; got != routeOK+1 {
+		t.Errorf("%s GET 200 = %v, want %v", route, got, routeOK+1)
+	}
+	if got := adaptertest.Series(t, infra.OtherAPI)["GET 200"]; got != otherOK {
+		t.Errorf("other GET 200 = %v, want %v", got, otherOK)
+	}
+}
@@ -0,0 +1,48 @@
+// Package ginadapter 让gin使用infra的监控，api标签是gin的路由模板，比如 /users/:id
+package ginadapter
+
+import (
+	"net/http"
+
+	"easymonitor/infra"
+	"github.com/gin-gonic/gin"
+)
+
+// Middleware 通过 engine.Use(ginadapter.Middleware()) 使用，需要放在其它中间件前面
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		done := false
+		infra.ServeInstrumented(c.Writer, c.Request, ginState{c}, func(r *http.Request) {
+			c.Request = r
+			c.Next()
+			done = true
+		})
+		// 被限流或者panic时后面的handler不再执行
+		if !done {
+			c.Abort()
+		}
+	}
+}
+
+type ginState struct {
+	c *gin.Context
+}
+
+func (s ginState) Route() string {
+	return s.c.FullPath()
+}
+
+func (s ginState) Status() int {
+	return s.c.Writer.Status()
+}
+
+func (s ginState) Written() int64 {
+	if size := s.c.Writer.Size(); size > 0 {
+		return int64(size)
+	}
+	return 0
+}
+
+func (s ginState) Committed() bool {
+	return s.c.Writer.Written()
+}
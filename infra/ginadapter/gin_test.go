@@ -0,0 +1,29 @@
+package ginadapter
+
+import (
+	"testing"
+
+	"easymonitor/infra"
+	"easymonitor/infra/internal/adaptertest"
+	"github.com/gin-gonic/gin"
+)
+
+func TestGinSeries(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	baseline := adaptertest.NetHTTPBaseline(t, "/gin-nethttp")
+	otherBefore := adaptertest.Series(t, infra.OtherAPI)["GET 404"]
+
+	engine := gin.New()
+	engine.Use(Middleware())
+	after := 0
+	handler := func(c *gin.Context) { adaptertest.Respond(c.Writer, c.Request) }
+	engine.Handle("GET", "/gin/users/:id", handler, func(c *gin.Context) { after++ })
+	engine.Handle("POST", "/gin/users/:id", handler)
+	adaptertest.Serve(engine, "/gin")
+
+	adaptertest.AssertSameSeries(t, "/gin/users/:id", baseline, otherBefore)
+	// panic之后的handler不能再执行
+	if after != 2 {
+		t.Errorf("handlers after the route ran %d times, want 2", after)
+	}
+}
@@ -0,0 +1,239 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const defaultGrpcSlowThreshold = time.Second
+
+// grpc指标的method标签
+const (
+	grpcUnary  = "unary"
+	grpcStream = "stream"
+)
+
+type grpcMonitor struct {
+	mu            sync.RWMutex
+	slowThreshold time.Duration
+}
+
+var GrpcMonitor = &grpcMonitor{slowThreshold: defaultGrpcSlowThreshold}
+
+// SetSlowThreshold 设置grpc服务端和客户端的慢调用阈值，默认1s
+func (g *grpcMonitor) SetSlowThreshold(d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.slowThreshold = d
+}
+
+func (g *grpcMonitor) getSlowThreshold() time.Duration {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.slowThreshold
+}
+
+// UnaryServerInterceptor 记录server_handle_total和server_handle_seconds，api标签是完整的方法名，status是数字形式的grpc状态码，
+// 同时恢复handler的panic
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		err = GrpcMonitor.serve(ctx, info.FullMethod, grpcUnary, func(ctx context.Context) error {
+			var err error
+			resp, err = handler(ctx, req)
+			return err
+		})
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor 和UnaryServerInterceptor一样，按整个stream的耗时记录
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return GrpcMonitor.serve(ss.Context(), info.FullMethod, grpcStream, func(ctx context.Context) error {
+			return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+		})
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (g *grpcMonitor) serve(ctx context.Context, fullMethod string, rpcType string, handler func(ctx context.Context) error) (err error) {
+	start := time.Now()
+	tc, ok := TraceFromContext(ctx)
+	if !ok {
+		tc = traceFromMetadata(ctx)
+	}
+	service, method := splitFullMethod(fullMethod)
+	ctx, span := TraceMonitor.startServerSpan(withRequestState(ContextWithTrace(ctx, tc)), fullMethod,
+		semconv.RPCSystemGRPC,
+		semconv.RPCService(service),
+		semconv.RPCMethod(method),
+	)
+	defer func() {
+		if p := recover(); p != nil {
+			serverPanicCounter.WithLabelValues(fullMethod).Inc()
+			log.WithFields(withRequestFields(ctx, log.Fields{
+				"panic":  fmt.Sprint(p),
+				"method": rpcType,
+				"api":    fullMethod,
+				Stack:    fmt.Sprintf("%+v", callersDepth(4, 32)),
+			})).Error("panic")
+			err = status.Error(codes.Internal, "internal error")
+		}
+		cost := time.Since(start)
+		code := status.Code(err)
+		MetricMonitor.RecordServerCount(TypeGRPC, rpcType, fullMethod)
+		MetricMonitor.RecordServerHandlerSecondsContext(ctx, TypeGRPC, rpcType, int(code), fullMethod, cost.Seconds())
+		if span != nil {
+			span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+		}
+		endSpan(span, err)
+		data := withRequestFields(ctx, log.Fields{
+			"api":  fullMethod,
+			"code": code.String(),
+			Cost:   cost.Milliseconds(),
+		})
+		if code != codes.OK {
+			data[log.ErrorKey] = err.Error()
+			log.WithFields(data).Warn("grpc request fail")
+		} else if cost >= g.getSlowThreshold() {
+			data[MetricType] = "slowLog"
+			log.WithFields(data).Warn("grpc request slow")
+		}
+	}()
+	return handler(ctx)
+}
+
+// UnaryClientInterceptor 记录client_handle_total和client_handle_seconds，name是完整的方法名，op是数字形式的grpc状态码，
+// 并通过metadata传递traceparent
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, finish := GrpcMonitor.startClient(ctx, method, cc.Target())
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		finish(err)
+		return err
+	}
+}
+
+// StreamClientInterceptor 在stream读到结束或者出错时记录，调用方没有把stream读完时不会记录
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, finish := GrpcMonitor.startClient(ctx, method, cc.Target())
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			finish(err)
+			return nil, err
+		}
+		return &clientStream{ClientStream: cs, serverStreams: desc.ServerStreams, finish: finish}, nil
+	}
+}
+
+type clientStream struct {
+	grpc.ClientStream
+	serverStreams bool
+	once          sync.Once
+	finish        func(err error)
+}
+
+func (s *clientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case err == io.EOF:
+		s.once.Do(func() { s.finish(nil) })
+	case err != nil:
+		s.once.Do(func() { s.finish(err) })
+	case !s.serverStreams:
+		// 客户端流只有一个响应
+		s.once.Do(func() { s.finish(nil) })
+	}
+	return err
+}
+
+func (g *grpcMonitor) startClient(ctx context.Context, fullMethod string, target string) (context.Context, func(err error)) {
+	start := time.Now()
+	peer := grpcPeer(target)
+	service, method := splitFullMethod(fullMethod)
+	ctx, span := TraceMonitor.startSpan(ctx, fullMethod, trace.SpanKindClient,
+		semconv.RPCSystemGRPC,
+		semconv.RPCService(service),
+		semconv.RPCMethod(method),
+		semconv.NetPeerName(peer),
+	)
+	if span == nil {
+		ctx = ContextWithTrace(ctx, clientTrace(ctx))
+	}
+	tc, _ := TraceFromContext(ctx)
+	ctx = metadata.AppendToOutgoingContext(ctx, traceparentHeader, tc.Traceparent())
+	return ctx, func(err error) {
+		cost := time.Since(start)
+		code := status.Code(err)
+		if span != nil {
+			span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+		}
+		endSpan(span, err)
+		// 和服务端的status标签一样用数字code，面板可以直接关联两端
+		op := strconv.Itoa(int(code))
+		MetricMonitor.RecordClientCount(TypeGRPC, op, fullMethod, peer)
+		MetricMonitor.RecordClientHandlerSecondsContext(ctx, TypeGRPC, op, fullMethod, peer, cost.Seconds())
+		data := withRequestFields(ctx, log.Fields{
+			Cost:     cost.Milliseconds(),
+			"method": fullMethod,
+			"peer":   peer,
+			"code":   code.String(),
+		})
+		if err != nil {
+			data[log.ErrorKey] = err.Error()
+			log.WithFields(data).Error("grpcclienterrlog")
+		} else if cost >= g.getSlowThreshold() {
+			MetricMonitor.RecordClientSlowCount(TypeGRPC, op, fullMethod, peer)
+			data[MetricType] = "slowLog"
+			log.WithFields(data).Warn("grpcclientslowlog")
+		}
+	}
+}
+
+// traceFromMetadata 从grpc metadata的traceparent继承链路
+func traceFromMetadata(ctx context.Context) TraceContext {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(traceparentHeader); len(values) > 0 {
+		return traceFromTraceparent(values[0])
+	}
+	return traceFromTraceparent("")
+}
+
+// splitFullMethod 把 /package.Service/Method 拆成服务名和方法名
+func splitFullMethod(fullMethod string) (string, string) {
+	name := strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// grpcPeer 去掉target中的scheme和端口，比如 dns:///user.svc:9000 返回 user.svc
+func grpcPeer(target string) string {
+	if i := strings.LastIndex(target, "/"); i >= 0 {
+		target = target[i+1:]
+	}
+	return peerHost(target)
+}
@@ -0,0 +1,122 @@
+package infra
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// healthServer 按服务名返回不同结果，"panic" 会让handler panic
+type healthServer struct {
+	healthpb.UnimplementedHealthServer
+	traceparent string
+}
+
+func (s *healthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get("traceparent"); len(v) > 0 {
+		s.traceparent = v[0]
+	}
+	switch req.GetService() {
+	case "panic":
+		panic("boom")
+	case "missing":
+		return nil, status.Error(codes.NotFound, "unknown service")
+	}
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+func (s *healthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	if _, ok := TraceFromContext(stream.Context()); !ok {
+		return status.Error(codes.Internal, "stream context has no trace")
+	}
+	for i := 0; i < 2; i++ {
+		if err := stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestGrpcInterceptors(t *testing.T) {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor()),
+		grpc.StreamInterceptor(StreamServerInterceptor()),
+	)
+	health := &healthServer{}
+	healthpb.RegisterHealthServer(server, health)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(StreamClientInterceptor()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	ctx := context.Background()
+
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, ok := parseTraceparent(health.traceparent); !ok {
+		t.Errorf("traceparent not propagated: %q", health.traceparent)
+	}
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "missing"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("missing err = %v", err)
+	}
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "panic"}); status.Code(err) != codes.Internal {
+		t.Fatalf("panic err = %v", err)
+	}
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := stream.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const check = "/grpc.health.v1.Health/Check"
+	const watch = "/grpc.health.v1.Health/Watch"
+	if v, _ := gatherValue(t, serverHandleCounter, "server_handle_total", map[string]string{"type": TypeGRPC, "method": grpcUnary, "api": check}); v != 3 {
+		t.Errorf("server_handle_total Check = %v, want 3", v)
+	}
+	for code, want := range map[string]float64{"0": 1, "5": 1, "13": 1} {
+		if v, _ := gatherValue(t, serverHandleHistogram, "server_handle_seconds", map[string]string{"type": TypeGRPC, "api": check, "status": code}); v != want {
+			t.Errorf("server_handle_seconds{status=%s} = %v, want %v", code, v, want)
+		}
+	}
+	if v, _ := gatherValue(t, serverHandleHistogram, "server_handle_seconds", map[string]string{"type": TypeGRPC, "method": grpcStream, "api": watch, "status": "0"}); v != 1 {
+		t.Errorf("server_handle_seconds Watch = %v, want 1", v)
+	}
+	if v, _ := gatherValue(t, serverPanicCounter, "server_panics_total", map[string]string{"api": check}); v != 1 {
+		t.Errorf("server_panics_total = %v, want 1", v)
+	}
+	for op, name := range map[string]string{"0": check, "5": check, "13": check} {
+		if v, _ := gatherValue(t, clientHandleCounter, "client_handle_total", map[string]string{"type": TypeGRPC, "name": name, "op": op, "peer": "bufnet"}); v != 1 {
+			t.Errorf("client_handle_total{op=%s} = %v, want 1", op, v)
+		}
+	}
+	if v, _ := gatherValue(t, clientHandleHistogram, "client_handle_seconds", map[string]string{"type": TypeGRPC, "name": watch, "op": "0"}); v != 1 {
+		t.Errorf("client_handle_seconds Watch = %v, want 1", v)
+	}
+}
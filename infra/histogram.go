@@ -0,0 +1,111 @@
+package infra
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// typedHistogram 按type标签使用不同的桶，每个type一个HistogramVec，
+// 修改桶或者开启native histogram会重建对应的vec，已有的数据会清空，需要在启动时设置
+type typedHistogram struct {
+	name           string
+	labelNames     []string
+	defaultBuckets []float64
+
+	mu           sync.RWMutex
+	buckets      map[string][]float64
+	nativeFactor float64
+	vecs         map[string]*prometheus.HistogramVec
+}
+
+func newTypedHistogram(name string, labelNames []string, defaultBuckets []float64, buckets map[string][]float64) *typedHistogram {
+	if buckets == nil {
+		buckets = make(map[string][]float64)
+	}
+	return &typedHistogram{
+		name:           name,
+		labelNames:     labelNames,
+		defaultBuckets: defaultBuckets,
+		buckets:        buckets,
+		vecs:           make(map[string]*prometheus.HistogramVec),
+	}
+}
+
+func (h *typedHistogram) With(labels prometheus.Labels) prometheus.Observer {
+	return h.vec(labels["type"]).With(labels)
+}
+
+func (h *typedHistogram) vec(metricType string) *prometheus.HistogramVec {
+	h.mu.RLock()
+	vec, ok := h.vecs[metricType]
+	h.mu.RUnlock()
+	if ok {
+		return vec
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if vec, ok = h.vecs[metricType]; ok {
+		return vec
+	}
+	buckets, ok := h.buckets[metricType]
+	if !ok {
+		buckets = h.defaultBuckets
+	}
+	opts := prometheus.HistogramOpts{
+		Name:    h.name,
+		Buckets: buckets,
+	}
+	if h.nativeFactor > 1 {
+		opts.NativeHistogramBucketFactor = h.nativeFactor
+		opts.NativeHistogramMaxBucketNumber = 160
+		opts.NativeHistogramMinResetDuration = time.Hour
+	}
+	vec = prometheus.NewHistogramVec(opts, h.labelNames)
+	h.vecs[metricType] = vec
+	return vec
+}
+
+func (h *typedHistogram) setBuckets(metricType string, buckets []float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buckets[metricType] = buckets
+	delete(h.vecs, metricType)
+}
+
+func (h *typedHistogram) setNativeFactor(factor float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nativeFactor = factor
+	h.vecs = make(map[string]*prometheus.HistogramVec)
+}
+
+// Describe 不同type的桶不一样，作为unchecked collector注册
+func (h *typedHistogram) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (h *typedHistogram) Collect(ch chan<- prometheus.Metric) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, vec := range h.vecs {
+		vec.Collect(ch)
+	}
+}
+
+// SetServerBuckets 设置server_handle_seconds中某个type的桶，比如批处理接口需要10s以上的桶
+func (m *metricMonitor) SetServerBuckets(metricType string, buckets []float64) {
+	serverHandleHistogram.setBuckets(metricType, buckets)
+}
+
+// SetClientBuckets 设置client_handle_seconds中某个type的桶，redis默认使用0.1ms开始的桶
+func (m *metricMonitor) SetClientBuckets(metricType string, buckets []float64) {
+	clientHandleHistogram.setBuckets(metricType, buckets)
+}
+
+// EnableNativeHistograms 让server_handle_seconds和client_handle_seconds同时输出native histogram，
+// bucketFactor 是相邻桶的最大比例，比如1.1，prometheus需要开启native-histograms特性
+func (m *metricMonitor) EnableNativeHistograms(bucketFactor float64) {
+	serverHandleHistogram.setNativeFactor(bucketFactor)
+	clientHandleHistogram.setNativeFactor(bucketFactor)
+}
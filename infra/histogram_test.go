@@ -0,0 +1,64 @@
+package infra
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func histogramFor(t *testing.T, c prometheus.Collector, name string, labels map[string]string) *dto.Histogram {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	next:
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if v, ok := labels[lp.GetName()]; ok && v != lp.GetValue() {
+					continue next
+				}
+			}
+			return m.GetHistogram()
+		}
+	}
+	t.Fatalf("%s%v not found", name, labels)
+	return nil
+}
+
+func TestTypedHistogramBuckets(t *testing.T) {
+	h := newTypedHistogram("typed_seconds", []string{"type", "api"}, prometheus.DefBuckets, map[string][]float64{
+		TypeRedis: {0.001, 0.01},
+	})
+	h.setBuckets(TypeHTTP, []float64{1, 10, 60})
+	h.With(prometheus.Labels{"type": TypeRedis, "api": "get"}).Observe(0.0005)
+	h.With(prometheus.Labels{"type": TypeHTTP, "api": "/batch"}).Observe(30)
+	h.With(prometheus.Labels{"type": TypeMySQL, "api": "select"}).Observe(0.2)
+
+	if got := len(histogramFor(t, h, "typed_seconds", map[string]string{"type": TypeRedis}).GetBucket()); got != 2 {
+		t.Errorf("redis buckets = %d, want 2", got)
+	}
+	if got := histogramFor(t, h, "typed_seconds", map[string]string{"type": TypeHTTP}).GetBucket(); len(got) != 3 || got[2].GetCumulativeCount() != 1 || got[1].GetCumulativeCount() != 0 {
+		t.Errorf("http buckets = %v", got)
+	}
+	if got := len(histogramFor(t, h, "typed_seconds", map[string]string{"type": TypeMySQL}).GetBucket()); got != len(prometheus.DefBuckets) {
+		t.Errorf("mysql buckets = %d, want default", got)
+	}
+
+	h.setNativeFactor(1.1)
+	h.With(prometheus.Labels{"type": TypeRedis, "api": "get"}).Observe(0.0005)
+	hist := histogramFor(t, h, "typed_seconds", map[string]string{"type": TypeRedis})
+	if hist.GetSchema() == 0 && len(hist.GetPositiveSpan()) == 0 {
+		t.Errorf("native histogram not exported: %v", hist)
+	}
+	if got := len(hist.GetBucket()); got != 2 {
+		t.Errorf("classic buckets dropped with native enabled: %d", got)
+	}
+}
@@ -10,16 +10,25 @@ import (
 	"time"
 
 	"github.com/go-sql-driver/mysql"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func registerHookDriver(dbname string) {
-	sql.Register(dbname, Wrap(mysql.MySQLDriver{}, &HookDb{dbName: dbname}))
+func registerHookDriver(dbname string, connStr string) {
+	hook := &HookDb{dbName: dbname}
+	if cfg, err := mysql.ParseDSN(connStr); err == nil {
+		hook.peer = peerHost(cfg.Addr)
+		hook.database = cfg.DBName
+	}
+	sql.Register(dbname, Wrap(mysql.MySQLDriver{}, hook))
 }
 
 // HookDb satisfies the sql hook.Hooks interface
 type HookDb struct {
-	dbName string
-	app    string
+	dbName   string
+	app      string
+	peer     string
+	database string
 }
 
 const (
@@ -28,6 +37,7 @@ const (
 	ctxKeyMultiTable = "multi_table"
 	ctxKeyTbName     = "tbname"
 	ctxKeyBeginTime  = "begin"
+	ctxKeySpan       = "span"
 )
 
 // Before hook will print the query with it's args and return the context with the timestamp
@@ -47,6 +57,21 @@ func (h *HookDb) Before(ctx context.Context, query string, args ...interface{})
 	if op != Unknown {
 		ctx = context.WithValue(ctx, ctxKeyOp, op)
 	}
+	table := ""
+	if len(tables) >= 1 {
+		table = tables[0]
+	}
+	ctx, span := TraceMonitor.startSpan(ctx, sqlSpanName(op, table), trace.SpanKindClient,
+		semconv.DBSystemMySQL,
+		semconv.DBName(h.database),
+		semconv.DBStatement(redactSql(query)),
+		semconv.DBOperation(string(op)),
+		semconv.DBSQLTable(table),
+		semconv.NetPeerName(h.peer),
+	)
+	if span != nil {
+		ctx = context.WithValue(ctx, ctxKeySpan, span)
+	}
 	return ctx, nil
 }
 
@@ -63,11 +88,13 @@ func (h *HookDb) After(ctx context.Context, query string, args ...interface{}) (
 	if begin := ctx.Value(ctxKeyBeginTime); begin != nil {
 		beginTime = begin.(time.Time)
 	}
+	defer endSpan(hookSpan(ctx), nil)
 	now := time.Now()
+	tenantUsage.addDuration(ctx, TypeMySQL, now.Sub(beginTime).Seconds())
 	tableName := ""
 	if tbnameInf := ctx.Value(ctxKeyTbName); tbnameInf != nil && len(tbnameInf.(string)) != 0 {
 		tableName = tbnameInf.(string)
-		MetricMonitor.RecordClientHandlerSeconds(TypeMySQL, string(ctx.Value(ctxKeyOp).(SqlOp)), tbnameInf.(string), h.dbName, now.Sub(beginTime).Seconds())
+		MetricMonitor.RecordClientHandlerSecondsContext(ctx, TypeMySQL, string(ctx.Value(ctxKeyOp).(SqlOp)), tbnameInf.(string), h.dbName, now.Sub(beginTime).Seconds())
 	}
 	slowquery := false
 	if now.Sub(beginTime).Seconds() >= 1 {
@@ -82,7 +109,7 @@ func (h *HookDb) After(ctx context.Context, query string, args ...interface{}) (
 			"tableName": tableName,
 			"op":        ctx.Value(ctxKeyOp),
 		}
-		log.WithFields(data).Errorf("mysqlslowlog")
+		log.WithFields(withRequestFields(ctx, data)).Errorf("mysqlslowlog")
 	}
 	op := ctx.Value(ctxKeyOp).(SqlOp)
 	multitable := ctx.Value(ctxKeyMultiTable)
@@ -97,7 +124,24 @@ func (h *HookDb) After(ctx context.Context, query string, args ...interface{}) (
 			"tableName": tableName,
 			"op":        ctx.Value(ctxKeyOp),
 		}
-		log.WithFields(data).Warnf("mysqlmultitableslog")
+		log.WithFields(withRequestFields(ctx, data)).Warnf("mysqlmultitableslog")
+	}
+	// 缓存击穿之后的sql，和cacheStampede事件关联起来
+	if state := requestStateFrom(ctx); state != nil {
+		if stampedeID, stampedeKey := state.stampede(); stampedeID != "" {
+			data := log.Fields{
+				Cost:          now.Sub(beginTime).Milliseconds(),
+				"query":       truncateKey(1024, query),
+				MetricType:    "cacheStampedeSql",
+				"app":         h.app,
+				"dbName":      h.dbName,
+				"tableName":   tableName,
+				"op":          ctx.Value(ctxKeyOp),
+				"stampedeId":  stampedeID,
+				"stampedeKey": stampedeKey,
+			}
+			log.WithFields(withRequestFields(ctx, data)).Warnf("cacheStampedeSql")
+		}
 	}
 	// 对修改sql进行日志记录
 	if op != Select && op != Unknown {
@@ -111,13 +155,17 @@ func (h *HookDb) After(ctx context.Context, query string, args ...interface{}) (
 			"tableName": tableName,
 			"op":        ctx.Value(ctxKeyOp),
 		}
-		log.WithFields(data).Infof("mysqloplog")
+		log.WithFields(withRequestFields(ctx, data)).Infof("mysqloplog")
 	}
 	return ctx, nil
 }
 
 func (h *HookDb) OnError(ctx context.Context, err error, query string, args ...interface{}) error {
-	if err != driver.ErrSkip {
+	// ErrSkip 表示驱动会换成prepare的方式重新执行，不算失败
+	if err == driver.ErrSkip {
+		endSpan(hookSpan(ctx), nil)
+	} else {
+		endSpan(hookSpan(ctx), err)
 		tableName := ""
 		if tbnameInf := ctx.Value(ctxKeyTbName); tbnameInf != nil && len(tbnameInf.(string)) != 0 {
 			tableName = tbnameInf.(string)
@@ -136,11 +184,16 @@ func (h *HookDb) OnError(ctx context.Context, err error, query string, args ...i
 			"tableName": tableName,
 			"op":        ctx.Value(ctxKeyOp),
 		}
-		log.WithFields(data).WithError(err).Errorf("mysqlerrlog")
+		log.WithFields(withRequestFields(ctx, data)).WithError(err).Errorf("mysqlerrlog")
 	}
 	return err
 }
 
+func hookSpan(ctx context.Context) trace.Span {
+	span, _ := ctx.Value(ctxKeySpan).(trace.Span)
+	return span
+}
+
 var (
 	LocalDbClient = make(map[string]*sql.DB)
 )
@@ -179,7 +232,7 @@ func decorateMySQLConn(conn string) string {
 
 func (s *sqlMonitor) InitHookDb(dbInfos []*DbInfo) {
 	for _, dbInfo := range dbInfos {
-		registerHookDriver(dbInfo.DbName)
+		registerHookDriver(dbInfo.DbName, dbInfo.ConnStr)
 		maxConn := dbInfo.MaxConn
 		timeout := 1
 		if dbInfo.Timeout > 0 {
@@ -0,0 +1,131 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"time"
+)
+
+const defaultClientSlowThreshold = time.Second
+
+type ctxKeyClientRoute struct{}
+
+// WithClientRoute 指定下游请求的路由模板，比如 /users/{id}，不指定时对path做NormalizePath，
+// 每个InstrumentedTransport最多记录 HttpMonitor.SetMaxNormalizedPaths 个归一化path，超过之后为other
+func WithClientRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, ctxKeyClientRoute{}, route)
+}
+
+// SetClientSlowThreshold 设置下游http请求的慢请求阈值，默认1s
+func (h *httpMonitor) SetClientSlowThreshold(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clientSlowThreshold = d
+}
+
+func (h *httpMonitor) getClientSlowThreshold() time.Duration {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.clientSlowThreshold <= 0 {
+		return defaultClientSlowThreshold
+	}
+	return h.clientSlowThreshold
+}
+
+type instrumentedTransport struct {
+	rt     http.RoundTripper
+	name   string
+	routes *pathLabels
+}
+
+// InstrumentedTransport 记录下游http请求的client_handle_total和client_handle_seconds，并传递traceparent，
+// name 是下游服务的名字，rt为空时使用http.DefaultTransport
+func InstrumentedTransport(rt http.RoundTripper, name string) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &instrumentedTransport{rt: rt, name: name, routes: newPathLabels(HttpMonitor.getMaxNormalizedPaths())}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	route, _ := req.Context().Value(ctxKeyClientRoute{}).(string)
+	if route == "" {
+		route = t.routes.label(NormalizePath(req.URL.Path))
+	}
+	peer := req.URL.Hostname()
+	ctx, span := TraceMonitor.startSpan(req.Context(), req.Method+" "+route, trace.SpanKindClient,
+		semconv.HTTPMethod(req.Method),
+		semconv.HTTPRoute(route),
+		semconv.NetPeerName(peer),
+	)
+	if span == nil {
+		ctx = ContextWithTrace(ctx, clientTrace(ctx))
+	}
+	tc, _ := TraceFromContext(ctx)
+	// RoundTripper 不能修改传入的请求
+	req = req.Clone(ctx)
+	req.Header.Set(traceparentHeader, tc.Traceparent())
+
+	start := time.Now()
+	resp, err := t.rt.RoundTrip(req)
+	cost := time.Since(start)
+
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	if span != nil && status != 0 {
+		span.SetAttributes(semconv.HTTPStatusCode(status))
+	}
+	if err == nil && status >= http.StatusInternalServerError {
+		endSpan(span, fmt.Errorf("http status %d", status))
+	} else {
+		endSpan(span, err)
+	}
+
+	name := t.name + " " + route
+	op := req.Method + " " + statusClass(status, err)
+	MetricMonitor.RecordClientCount(TypeHTTP, op, name, peer)
+	MetricMonitor.RecordClientHandlerSecondsContext(ctx, TypeHTTP, op, name, peer, cost.Seconds())
+
+	data := withRequestFields(ctx, log.Fields{
+		Cost:     cost.Milliseconds(),
+		"app":    t.name,
+		"method": req.Method,
+		"route":  route,
+		"url":    req.URL.Scheme + "://" + req.URL.Host + req.URL.Path,
+		"status": status,
+	})
+	if err != nil || status >= http.StatusInternalServerError {
+		if err != nil {
+			data[log.ErrorKey] = err.Error()
+		}
+		log.WithFields(data).Error("httpclienterrlog")
+	} else if cost >= HttpMonitor.getClientSlowThreshold() {
+		MetricMonitor.RecordClientSlowCount(TypeHTTP, op, name, peer)
+		data[MetricType] = "slowLog"
+		log.WithFields(data).Warn("httpclientslowlog")
+	}
+	return resp, err
+}
+
+// clientTrace 没有开启链路上报时，为下游请求生成一个子span，请求不在链路里时生成新的链路
+func clientTrace(ctx context.Context) TraceContext {
+	parent, ok := TraceFromContext(ctx)
+	if !ok {
+		return TraceContext{TraceID: newTraceID(), SpanID: newSpanID(), Sampled: true}
+	}
+	return TraceContext{TraceID: parent.TraceID, SpanID: newSpanID(), ParentSpanID: parent.SpanID, Sampled: parent.Sampled}
+}
+
+// statusClass 返回 2xx、4xx 这样的状态码分类，请求失败时返回error
+func statusClass(status int, err error) string {
+	if err != nil || status == 0 {
+		return "error"
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
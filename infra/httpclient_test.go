@@ -0,0 +1,105 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestInstrumentedTransport(t *testing.T) {
+	var gotTraceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTraceparent = r.Header.Get("traceparent")
+		if strings.HasPrefix(r.URL.Path, "/orders/") {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+	var buf bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+
+	client := &http.Client{Transport: InstrumentedTransport(nil, "usersvc")}
+	parent := TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Sampled: true}
+	req, _ := http.NewRequestWithContext(ContextWithTrace(context.Background(), parent), http.MethodGet, server.URL+"/users/12", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if req.Header.Get("traceparent") != "" {
+		t.Error("transport modified the caller's request")
+	}
+	traceID, parentID, sampled, ok := parseTraceparent(gotTraceparent)
+	if !ok || traceID != parent.TraceID || parentID == parent.SpanID || !sampled {
+		t.Errorf("traceparent = %q", gotTraceparent)
+	}
+
+	req, _ = http.NewRequestWithContext(WithClientRoute(context.Background(), "/orders/{id}"), http.MethodPost, server.URL+"/orders/abc", nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	peer := "127.0.0.1"
+	if v, _ := gatherValue(t, clientHandleCounter, "client_handle_total", map[string]string{"type": TypeHTTP, "name": "usersvc /users/:id", "op": "GET 2xx", "peer": peer}); v != 1 {
+		t.Errorf("client_handle_total GET 2xx = %v, want 1", v)
+	}
+	if v, _ := gatherValue(t, clientHandleHistogram, "client_handle_seconds", map[string]string{"type": TypeHTTP, "name": "usersvc /orders/{id}", "op": "POST 5xx", "peer": peer}); v != 1 {
+		t.Errorf("client_handle_seconds POST 5xx count = %v, want 1", v)
+	}
+	if !strings.Contains(buf.String(), "httpclienterrlog") || !strings.Contains(buf.String(), `"route":"/orders/{id}"`) {
+		t.Errorf("missing httpclienterrlog: %s", buf.String())
+	}
+}
+
+func TestInstrumentedTransportError(t *testing.T) {
+	rt := InstrumentedTransport(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("dial fail")
+	}), "down")
+	req, _ := http.NewRequest(http.MethodGet, "http://down.local/ping", nil)
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Fatal("expected error")
+	}
+	if v, _ := gatherValue(t, clientHandleCounter, "client_handle_total", map[string]string{"name": "down /ping", "op": "GET error", "peer": "down.local"}); v != 1 {
+		t.Errorf("client_handle_total GET error = %v, want 1", v)
+	}
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestInstrumentedTransportRouteCap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	HttpMonitor.SetMaxNormalizedPaths(2)
+	defer HttpMonitor.SetMaxNormalizedPaths(0)
+
+	client := &http.Client{Transport: InstrumentedTransport(nil, "capsvc")}
+	for _, path := range []string{"/a/1", "/b/2", "/c/3", "/d/4", "/a/5"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	for name, want := range map[string]float64{"capsvc /a/:id": 2, "capsvc /b/:id": 1, "capsvc " + OtherAPI: 2} {
+		if v, _ := gatherValue(t, clientHandleCounter, "client_handle_total", map[string]string{"type": TypeHTTP, "name": name}); v != want {
+			t.Errorf("client_handle_total{name=%q} = %v, want %v", name, v, want)
+		}
+	}
+	if _, ok := gatherValue(t, clientHandleCounter, "client_handle_total", map[string]string{"type": TypeHTTP, "name": "capsvc /c/:id"}); ok {
+		t.Error("route over the cap was recorded")
+	}
+}
@@ -0,0 +1,96 @@
+// Package adaptertest 是框架适配器测试共用的场景，
+// 每个适配器都要和net/http的MetricMiddleware产生同样的server_handle_seconds序列
+package adaptertest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"easymonitor/infra"
+)
+
+// Call 是场景中的一次请求，path 相对于路由前缀
+type Call struct {
+	Method string
+	Path   string
+}
+
+// Calls 命中 <prefix>/users/:id 路由的请求，panic=1 时handler会panic
+var Calls = []Call{
+	{http.MethodGet, "/users/7"},
+	{http.MethodGet, "/users/8"},
+	{http.MethodPost, "/users/7"},
+	{http.MethodGet, "/users/9?panic=1"},
+}
+
+// NotFound 没有匹配路由的请求
+var NotFound = Call{http.MethodGet, "/missing/1"}
+
+// Respond 是各个框架的 /users/:id handler 的逻辑
+func Respond(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("panic") != "" {
+		panic("boom")
+	}
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write([]byte("ok"))
+}
+
+// Serve 用httptest依次发送Calls和NotFound
+func Serve(handler http.Handler, prefix string) {
+	for _, c := range append(Calls, NotFound) {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(c.Method, prefix+c.Path, nil))
+	}
+}
+
+// NetHTTPBaseline 用MetricMiddleware和RecoveryMiddleware执行同样的场景，返回路由上的序列
+func NetHTTPBaseline(t testing.TB, prefix string) map[string]float64 {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix+NotFound.Path {
+			http.NotFound(w, r)
+			return
+		}
+		Respond(w, r)
+	})
+	Serve(infra.MetricMiddleware(infra.RecoveryMiddleware(handler)), prefix)
+	return Series(t, prefix+"/users/:id")
+}
+
+// Series 返回api对应的server_handle_seconds序列，key 是 "method status"，value 是请求数
+func Series(t testing.TB, api string) map[string]float64 {
+	families, err := infra.MetricsReg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "server_handle_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if len(labels) != 4 || labels["type"] != infra.TypeHTTP || labels["api"] != api {
+				continue
+			}
+			series[labels["method"]+" "+labels["status"]] = float64(m.GetHistogram().GetSampleCount())
+		}
+	}
+	return series
+}
+
+// AssertSameSeries 检查适配器在路由模板route上的序列和net/http的一致，并且未匹配的请求记到other
+func AssertSameSeries(t testing.TB, route string, baseline map[string]float64, otherBefore float64) {
+	got := Series(t, route)
+	if fmt.Sprint(got) != fmt.Sprint(baseline) || len(got) != 3 {
+		t.Errorf("series for %s = %v, want %v", route, got, baseline)
+	}
+	if other := Series(t, infra.OtherAPI)["GET 404"]; other != otherBefore+1 {
+		t.Errorf("other GET 404 = %v, want %v", other, otherBefore+1)
+	}
+}
@@ -1,48 +1,245 @@
 package infra
 
 import (
-	log "github.com/sirupsen/logrus"
+	"bufio"
+	"io"
+	"net"
 	"net/http"
-	"net/http/httputil"
-
-	"time"
 )
 
+// responseWriter 记录状态码和响应大小，可选接口由wrap按底层ResponseWriter的实现补上
 type responseWriter struct {
 	http.ResponseWriter
-	statusCode int
+	statusCode  int
+	wroteHeader bool
+	written     int64
 }
 
 func (rw *responseWriter) WriteHeader(statusCode int) {
-	rw.statusCode = statusCode
+	// 1xx 是中间响应，后面还会有最终的状态码，101除外
+	if !rw.wroteHeader && (statusCode >= 200 || statusCode == http.StatusSwitchingProtocols) {
+		rw.statusCode = statusCode
+		rw.wroteHeader = true
+	}
 	rw.ResponseWriter.WriteHeader(statusCode)
 }
 
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.markWritten()
+	n, err := rw.ResponseWriter.Write(b)
+	rw.written += int64(n)
+	return n, err
+}
+
+// markWritten 没有调用WriteHeader就写body时，net/http默认返回200
+func (rw *responseWriter) markWritten() {
+	if !rw.wroteHeader {
+		rw.statusCode = http.StatusOK
+		rw.wroteHeader = true
+	}
+}
+
 func (rw *responseWriter) Status() int {
+	if rw.statusCode == 0 {
+		return http.StatusOK
+	}
 	return rw.statusCode
 }
 
+func (rw *responseWriter) Written() int64 {
+	return rw.written
+}
+
+func (rw *responseWriter) Committed() bool {
+	return rw.wroteHeader
+}
+
+// netHTTPState net/http的路由模板由HttpMonitor在请求结束后解析
+type netHTTPState struct {
+	*responseWriter
+}
+
+func (netHTTPState) Route() string {
+	return ""
+}
+
+func (rw *responseWriter) flush() {
+	rw.markWritten()
+	rw.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (rw *responseWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if !rw.wroteHeader {
+		rw.statusCode = http.StatusSwitchingProtocols
+		rw.wroteHeader = true
+	}
+	return rw.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (rw *responseWriter) readFrom(src io.Reader) (int64, error) {
+	rw.markWritten()
+	n, err := rw.ResponseWriter.(io.ReaderFrom).ReadFrom(src)
+	rw.written += n
+	return n, err
+}
+
+func (rw *responseWriter) push(target string, opts *http.PushOptions) error {
+	return rw.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+type flusherFunc func()
+
+func (f flusherFunc) Flush() { f() }
+
+type hijackerFunc func() (net.Conn, *bufio.ReadWriter, error)
+
+func (f hijackerFunc) Hijack() (net.Conn, *bufio.ReadWriter, error) { return f() }
+
+type readerFromFunc func(src io.Reader) (int64, error)
+
+func (f readerFromFunc) ReadFrom(src io.Reader) (int64, error) { return f(src) }
+
+type pusherFunc func(target string, opts *http.PushOptions) error
+
+func (f pusherFunc) Push(target string, opts *http.PushOptions) error { return f(target, opts) }
+
+// wrap 返回交给handler的ResponseWriter，只实现底层ResponseWriter已经实现的Flusher、Hijacker、ReaderFrom、Pusher，
+// 这样handler里 w.(http.Hijacker) 的判断和底层保持一致
+func (rw *responseWriter) wrap() http.ResponseWriter {
+	var (
+		f http.Flusher
+		h http.Hijacker
+		r io.ReaderFrom
+		p http.Pusher
+		n int
+	)
+	if _, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f = flusherFunc(rw.flush)
+		n |= 1
+	}
+	if _, ok := rw.ResponseWriter.(http.Hijacker); ok {
+		h = hijackerFunc(rw.hijack)
+		n |= 2
+	}
+	if _, ok := rw.ResponseWriter.(io.ReaderFrom); ok {
+		r = readerFromFunc(rw.readFrom)
+		n |= 4
+	}
+	if _, ok := rw.ResponseWriter.(http.Pusher); ok {
+		p = pusherFunc(rw.push)
+		n |= 8
+	}
+	switch n {
+	case 1:
+		return struct {
+			*responseWriter
+			http.Flusher
+		}{rw, f}
+	case 2:
+		return struct {
+			*responseWriter
+			http.Hijacker
+		}{rw, h}
+	case 3:
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+		}{rw, f, h}
+	case 4:
+		return struct {
+			*responseWriter
+			io.ReaderFrom
+		}{rw, r}
+	case 5:
+		return struct {
+			*responseWriter
+			http.Flusher
+			io.ReaderFrom
+		}{rw, f, r}
+	case 6:
+		return struct {
+			*responseWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{rw, h, r}
+	case 7:
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{rw, f, h, r}
+	case 8:
+		return struct {
+			*responseWriter
+			http.Pusher
+		}{rw, p}
+	case 9:
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Pusher
+		}{rw, f, p}
+	case 10:
+		return struct {
+			*responseWriter
+			http.Hijacker
+			http.Pusher
+		}{rw, h, p}
+	case 11:
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{rw, f, h, p}
+	case 12:
+		return struct {
+			*responseWriter
+			io.ReaderFrom
+			http.Pusher
+		}{rw, r, p}
+	case 13:
+		return struct {
+			*responseWriter
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{rw, f, r, p}
+	case 14:
+		return struct {
+			*responseWriter
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{rw, h, r, p}
+	case 15:
+		return struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{rw, f, h, r, p}
+	}
+	return rw
+}
+
+// Unwrap 供 http.ResponseController 使用
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 type Middleware func(http.Handler) http.Handler
 
+// MetricMiddleware 记录请求的指标和日志，不处理panic，需要时在里面加上RecoveryMiddleware
 func MetricMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rw := &responseWriter{ResponseWriter: w}
-		// 在处理请求之前执行的逻辑
-		// 可以在这里进行请求验证、日志记录等操作
-		reqBody, err := httputil.DumpRequest(r, true)
-		if err != nil {
-			log.WithError(err).Errorf("dump request fail")
-		}
-		now := time.Now()
-		// 调用下一个处理程序
-		MetricMonitor.RecordServerCount(TypeHTTP, r.Method, r.URL.Path)
-		next.ServeHTTP(rw, r)
-		MetricMonitor.RecordServerHandlerSeconds(TypeHTTP, r.Method, rw.Status(), r.URL.Path, time.Now().Sub(now).Seconds())
-		if rw.Status() != http.StatusOK {
-			log.WithFields(log.Fields{
-				"request": string(reqBody),
-				"code":    rw.statusCode,
-			}).Warn("request fail ")
-		}
+		serveInstrumented(rw, r, netHTTPState{rw}, func(r *http.Request) {
+			// 调用下一个处理程序
+			next.ServeHTTP(rw.wrap(), r)
+		}, false)
 	})
 }
@@ -0,0 +1,83 @@
+package infra
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readerFromRecorder 在ResponseRecorder的基础上实现Hijacker和ReaderFrom
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r readerFromRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, http.ErrNotSupported
+}
+
+func (r readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestResponseWriterDefaultsAndInterfaces(t *testing.T) {
+	handler := MetricMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("wrapped writer hides http.Flusher")
+		}
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Error("wrapped writer hides http.Hijacker")
+		}
+		if _, ok := w.(http.Pusher); ok {
+			t.Error("wrapped writer exposes http.Pusher the underlying writer lacks")
+		}
+		rf, ok := w.(io.ReaderFrom)
+		if !ok {
+			t.Fatal("wrapped writer hides io.ReaderFrom")
+		}
+		io.WriteString(w, "hello ")
+		rf.ReadFrom(strings.NewReader("world"))
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(readerFromRecorder{rec}, httptest.NewRequest(http.MethodPost, "/writer/1", strings.NewReader("ping")))
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello world" {
+		t.Fatalf("response = %d %q", rec.Code, rec.Body.String())
+	}
+	labels := map[string]string{"type": TypeHTTP, "api": "/writer/:id"}
+	if v, _ := gatherValue(t, serverHandleHistogram, "server_handle_seconds", map[string]string{"api": "/writer/:id", "status": "200"}); v != 1 {
+		t.Errorf("server_handle_seconds{status=200} count = %v, want 1", v)
+	}
+	if v, _ := gatherValue(t, serverResponseSizeHistogram, "server_response_size_bytes", labels); v != 1 {
+		t.Errorf("server_response_size_bytes count = %v, want 1", v)
+	}
+	if v, _ := gatherValue(t, serverRequestSizeHistogram, "server_request_size_bytes", labels); v != 1 {
+		t.Errorf("server_request_size_bytes count = %v, want 1", v)
+	}
+}
+
+func TestResponseWriterMatchesInnerInterfaces(t *testing.T) {
+	handler := MetricMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// ResponseRecorder只实现了Flusher
+		if _, ok := w.(http.Hijacker); ok {
+			t.Error("wrapped writer exposes http.Hijacker")
+		}
+		if _, ok := w.(io.ReaderFrom); ok {
+			t.Error("wrapped writer exposes io.ReaderFrom")
+		}
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("ResponseController.Flush = %v", err)
+		}
+		if _, _, err := http.NewResponseController(w).Hijack(); err == nil {
+			t.Error("ResponseController.Hijack succeeded on a recorder")
+		}
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/flush", nil))
+	if !rec.Flushed || rec.Code != http.StatusOK {
+		t.Errorf("flushed = %v, code = %d", rec.Flushed, rec.Code)
+	}
+}
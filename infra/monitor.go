@@ -1,6 +1,7 @@
 package infra
 
 import (
+	"context"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -16,6 +17,8 @@ const (
 	TypeMySQL = "mysql"
 
 	TypeRedis = "redis"
+
+	TypeGRPC = "grpc"
 )
 
 var (
@@ -23,7 +26,7 @@ var (
 )
 
 func init() {
-	MetricsReg.MustRegister(serverHandleHistogram, serverHandleCounter, clientHandleHistogram, clientHandleCounter)
+	MetricsReg.MustRegister(serverHandleHistogram, serverHandleCounter, serverRequestSizeHistogram, serverResponseSizeHistogram, clientHandleHistogram, clientHandleCounter, clientSlowCounter)
 	MetricMonitor.RegPrometheusClient()
 }
 
@@ -33,20 +36,33 @@ type metricMonitor struct {
 var MetricMonitor = &metricMonitor{}
 
 var (
-	serverHandleHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name: "server_handle_seconds",
-	}, []string{"type", "method", "status", "api"})
+	serverHandleHistogram = newTypedHistogram("server_handle_seconds", []string{"type", "method", "status", "api"}, prometheus.DefBuckets, nil)
 
 	serverHandleCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "server_handle_total",
 	}, []string{"type", "method", "api"})
 
+	serverRequestSizeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "server_request_size_bytes",
+		Buckets: prometheus.ExponentialBuckets(100, 10, 7),
+	}, []string{"type", "method", "api"})
+
+	serverResponseSizeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "server_response_size_bytes",
+		Buckets: prometheus.ExponentialBuckets(100, 10, 7),
+	}, []string{"type", "method", "api"})
+
 	clientHandleCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "client_handle_total",
 	}, []string{"type", "name", "op", "peer"})
 
-	clientHandleHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name: "client_handle_seconds",
+	// redis的耗时通常在1ms以下，默认桶从0.1ms开始
+	clientHandleHistogram = newTypedHistogram("client_handle_seconds", []string{"type", "name", "op", "peer"}, prometheus.DefBuckets, map[string][]float64{
+		TypeRedis: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	})
+
+	clientSlowCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "client_slow_total",
 	}, []string{"type", "name", "op", "peer"})
 )
 
@@ -59,22 +75,51 @@ func (m *metricMonitor) RecordClientCount(metricType string, method string, name
 	}).Inc()
 }
 
+func (m *metricMonitor) RecordClientSlowCount(metricType string, method string, name string, peer string) {
+	clientSlowCounter.With(prometheus.Labels{
+		"type": metricType,
+		"op":   method,
+		"name": name,
+		"peer": peer,
+	}).Inc()
+}
+
 func (m *metricMonitor) RecordClientHandlerSeconds(metricType string, method, name string, peer string, second float64) {
-	clientHandleHistogram.With(prometheus.Labels{
+	m.RecordClientHandlerSecondsContext(context.Background(), metricType, method, name, peer, second)
+}
+
+// RecordClientHandlerSecondsContext 和RecordClientHandlerSeconds一样，ctx中有trace_id时作为exemplar记录
+func (m *metricMonitor) RecordClientHandlerSecondsContext(ctx context.Context, metricType string, method, name string, peer string, second float64) {
+	observeWithTrace(ctx, clientHandleHistogram.With(prometheus.Labels{
 		"type": metricType,
 		"op":   method,
 		"peer": peer,
 		"name": name,
-	}).Observe(second)
+	}), second)
+}
+
+func observeWithTrace(ctx context.Context, o prometheus.Observer, v float64) {
+	if t, ok := TraceFromContext(ctx); ok {
+		if eo, ok := o.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(v, prometheus.Labels{TraceIDField: t.TraceID})
+			return
+		}
+	}
+	o.Observe(v)
 }
 
 func (m *metricMonitor) RecordServerHandlerSeconds(metricType string, method string, status int, api string, second float64) {
-	serverHandleHistogram.With(prometheus.Labels{
+	m.RecordServerHandlerSecondsContext(context.Background(), metricType, method, status, api, second)
+}
+
+// RecordServerHandlerSecondsContext 和RecordServerHandlerSeconds一样，ctx中有trace_id时作为exemplar记录
+func (m *metricMonitor) RecordServerHandlerSecondsContext(ctx context.Context, metricType string, method string, status int, api string, second float64) {
+	observeWithTrace(ctx, serverHandleHistogram.With(prometheus.Labels{
 		"type":   metricType,
 		"method": method,
 		"status": strconv.Itoa(status),
 		"api":    api,
-	}).Observe(second)
+	}), second)
 }
 
 func (m *metricMonitor) RecordServerCount(metricType string, method string, api string) {
@@ -85,6 +130,22 @@ func (m *metricMonitor) RecordServerCount(metricType string, method string, api
 	}).Inc()
 }
 
+func (m *metricMonitor) RecordServerRequestSize(metricType string, method string, api string, size int64) {
+	serverRequestSizeHistogram.With(prometheus.Labels{
+		"type":   metricType,
+		"method": method,
+		"api":    api,
+	}).Observe(float64(size))
+}
+
+func (m *metricMonitor) RecordServerResponseSize(metricType string, method string, api string, size int64) {
+	serverResponseSizeHistogram.With(prometheus.Labels{
+		"type":   metricType,
+		"method": method,
+		"api":    api,
+	}).Observe(float64(size))
+}
+
 func (m *metricMonitor) RegPrometheusClient() {
 	MetricsReg.MustRegister(
 		collectors.NewGoCollector(
@@ -92,7 +153,7 @@ func (m *metricMonitor) RegPrometheusClient() {
 		),
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
-	http.Handle("/metrics", promhttp.HandlerFor(MetricsReg, promhttp.HandlerOpts{Registry: MetricsReg}))
+	http.Handle("/metrics", promhttp.HandlerFor(MetricsReg, promhttp.HandlerOpts{Registry: MetricsReg, EnableOpenMetrics: true}))
 	go func() {
 		http.ListenAndServe(":8090", http.DefaultServeMux)
 	}()
@@ -0,0 +1,212 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "easymonitor/infra"
+
+// TracingConfig OTLP链路上报的配置
+type TracingConfig struct {
+	ServiceName string
+	// OTLP/HTTP collector地址，比如 localhost:4318
+	Endpoint string
+	// 默认 /v1/traces
+	URLPath  string
+	Insecure bool
+	Headers  map[string]string
+	// 采样比例，0到1，默认1，上游已经决定采样时跟随上游
+	SampleRatio float64
+}
+
+type traceMonitor struct {
+	mu       sync.RWMutex
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+var TraceMonitor = &traceMonitor{}
+
+// Enable 开启OpenTelemetry链路上报，MetricMiddleware、HookDb和redis hook会创建span
+func (t *traceMonitor) Enable(cfg TracingConfig) error {
+	if cfg.Endpoint == "" {
+		return errors.New("tracing endpoint is empty")
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return fmt.Errorf("tracing sample ratio %v out of range [0, 1]", cfg.SampleRatio)
+	}
+	// 不设置时全部采样，TraceIDRatioBased(0)会丢掉所有的根span
+	if cfg.SampleRatio == 0 {
+		cfg.SampleRatio = 1
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.URLPath != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(cfg.URLPath))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.mu.Lock()
+	old := t.provider
+	t.provider, t.tracer = provider, provider.Tracer(tracerName)
+	t.mu.Unlock()
+	if old != nil {
+		old.Shutdown(context.Background())
+	}
+	return nil
+}
+
+// Shutdown 上报剩余的span并关闭
+func (t *traceMonitor) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	provider := t.provider
+	t.provider, t.tracer = nil, nil
+	t.mu.Unlock()
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(ctx)
+}
+
+func (t *traceMonitor) getTracer() trace.Tracer {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tracer
+}
+
+// startSpan 创建span并把span的id同步到ctx的TraceContext，日志里的span_id就是当前span，
+// 没有开启链路上报时返回nil
+func (t *traceMonitor) startSpan(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := t.getTracer()
+	if tracer == nil {
+		return ctx, nil
+	}
+	parent, hasParent := TraceFromContext(ctx)
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+	sc := span.SpanContext()
+	tc := TraceContext{TraceID: sc.TraceID().String(), SpanID: sc.SpanID().String(), Sampled: sc.IsSampled()}
+	if hasParent {
+		tc.ParentSpanID = parent.SpanID
+	}
+	return ContextWithTrace(ctx, tc), span
+}
+
+// startServerSpan 以traceparent中的上游span为父节点创建服务端span
+func (t *traceMonitor) startServerSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tc, _ := TraceFromContext(ctx)
+	if t.getTracer() == nil {
+		return ctx, nil
+	}
+	if tc.ParentSpanID != "" {
+		traceID, _ := trace.TraceIDFromHex(tc.TraceID)
+		spanID, _ := trace.SpanIDFromHex(tc.ParentSpanID)
+		var flags trace.TraceFlags
+		if tc.Sampled {
+			flags = trace.FlagsSampled
+		}
+		ctx = trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID: traceID, SpanID: spanID, TraceFlags: flags, Remote: true,
+		}))
+	}
+	ctx, span := t.startSpan(ctx, name, trace.SpanKindServer, attrs...)
+	server, _ := TraceFromContext(ctx)
+	server.ParentSpanID = tc.ParentSpanID
+	return ContextWithTrace(ctx, server), span
+}
+
+// endServerSpan 路由匹配之后才知道span名字和http.route
+func endServerSpan(span trace.Span, method string, api string, status int) {
+	if span == nil {
+		return
+	}
+	span.SetName(method + " " + api)
+	span.SetAttributes(semconv.HTTPRoute(api), semconv.HTTPStatusCode(status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// endSpan 结束span，err不为空时标记为失败
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+var sqlLiteral = regexp.MustCompile(`'(?:[^'\\]|\\.)*'|"(?:[^"\\]|\\.)*"|\b[0-9]+(?:\.[0-9]+)?\b`)
+
+// redactSql 把sql中的字符串和数字常量替换成?，避免db.statement里出现用户数据
+func redactSql(query string) string {
+	return truncateKey(1024, sqlLiteral.ReplaceAllString(query, "?"))
+}
+
+// redactRedisCmd 只保留命令名和第一个key，其余参数用?代替
+func redactRedisCmd(cmd redis.Cmder) string {
+	args := cmd.Args()
+	if len(args) < 2 {
+		return cmd.Name()
+	}
+	statement := cmd.Name() + " " + truncateKey(100, firstKey(cmd))
+	if len(args) > 2 {
+		statement += " ?"
+	}
+	return statement
+}
+
+// peerHost 去掉地址中的端口
+func peerHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func sqlSpanName(op SqlOp, table string) string {
+	name := strings.ToUpper(string(op))
+	if table != "" {
+		name = fmt.Sprintf("%s %s", name, table)
+	}
+	return name
+}
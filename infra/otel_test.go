@@ -0,0 +1,135 @@
+package infra
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-redis/redis"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpCollector 代替collector接收OTLP/HTTP上报的span
+type otlpCollector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	req := &collectortrace.ExportTraceServiceRequest{}
+	if r.URL.Path != "/v1/traces" || proto.Unmarshal(body, req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	for _, rs := range req.GetResourceSpans() {
+		for _, ss := range rs.GetScopeSpans() {
+			c.spans = append(c.spans, ss.GetSpans()...)
+		}
+	}
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	resp, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	w.Write(resp)
+}
+
+func spanAttr(span *tracepb.Span, key string) string {
+	for _, kv := range span.GetAttributes() {
+		if kv.GetKey() == key {
+			if s := kv.GetValue().GetStringValue(); s != "" {
+				return s
+			}
+			return kv.GetValue().String()
+		}
+	}
+	return ""
+}
+
+func TestOTLPSpans(t *testing.T) {
+	collector := &otlpCollector{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	if err := TraceMonitor.Enable(TracingConfig{
+		ServiceName: "oteltest",
+		Endpoint:    strings.TrimPrefix(server.URL, "http://"),
+		// 不设置SampleRatio时全部采样
+		Insecure: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer TraceMonitor.Shutdown(context.Background())
+
+	redisServer := newFakeRedis(t, func(args []string) string { return "$-1\r\n" })
+	client := redis.NewClient(&redis.Options{Addr: redisServer.Addr()})
+	defer client.Close()
+	RedisMonitor.AddRedisHook(client, "oteltest")
+	hook := &HookDb{dbName: "oteltest", peer: "db.local", database: "shop"}
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	var dbTrace TraceContext
+	handler := MetricMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RedisMonitor.WithContext(r.Context(), client).Get("user:1")
+		ctx, _ := hook.Before(r.Context(), "select name from users where id = 42 and email = 'a@b.c'")
+		dbTrace, _ = TraceFromContext(ctx)
+		hook.After(ctx, "select name from users where id = 42 and email = 'a@b.c'")
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/otel/7", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if err := TraceMonitor.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]*tracepb.Span{}
+	collector.mu.Lock()
+	for _, s := range collector.spans {
+		spans[s.GetName()] = s
+	}
+	collector.mu.Unlock()
+	serverSpan, dbSpan, redisSpan := spans["GET /otel/:id"], spans["SELECT users"], spans["get"]
+	if serverSpan == nil || dbSpan == nil || redisSpan == nil {
+		t.Fatalf("missing spans: %v", spans)
+	}
+	for _, s := range []*tracepb.Span{serverSpan, dbSpan, redisSpan} {
+		if got := hex.EncodeToString(s.GetTraceId()); got != traceID {
+			t.Errorf("span %s trace id = %s", s.GetName(), got)
+		}
+	}
+	if hex.EncodeToString(serverSpan.GetParentSpanId()) != "00f067aa0ba902b7" {
+		t.Errorf("server span parent = %x", serverSpan.GetParentSpanId())
+	}
+	if string(dbSpan.GetParentSpanId()) != string(serverSpan.GetSpanId()) || string(redisSpan.GetParentSpanId()) != string(serverSpan.GetSpanId()) {
+		t.Error("client spans are not children of the server span")
+	}
+	if dbTrace.SpanID != hex.EncodeToString(dbSpan.GetSpanId()) {
+		t.Errorf("log span_id %s does not match db span", dbTrace.SpanID)
+	}
+	if got := spanAttr(serverSpan, "http.route"); got != "/otel/:id" {
+		t.Errorf("http.route = %q", got)
+	}
+	if got := spanAttr(dbSpan, "db.statement"); got != "select name from users where id = ? and email = ?" {
+		t.Errorf("db.statement = %q", got)
+	}
+	if spanAttr(dbSpan, "db.system") != "mysql" || spanAttr(dbSpan, "db.sql.table") != "users" || spanAttr(dbSpan, "net.peer.name") != "db.local" {
+		t.Errorf("unexpected db span attributes: %v", dbSpan.GetAttributes())
+	}
+	if spanAttr(redisSpan, "db.system") != "redis" || spanAttr(redisSpan, "db.statement") != "get user:1" || spanAttr(redisSpan, "net.peer.name") != "127.0.0.1" {
+		t.Errorf("unexpected redis span attributes: %v", redisSpan.GetAttributes())
+	}
+}
+
+func TestTracingSampleRatioRange(t *testing.T) {
+	for _, ratio := range []float64{-0.1, 1.5} {
+		if err := (&traceMonitor{}).Enable(TracingConfig{Endpoint: "localhost:4318", SampleRatio: ratio}); err == nil {
+			t.Errorf("Enable accepted SampleRatio %v", ratio)
+		}
+	}
+}
@@ -13,3 +13,10 @@ create index t_agency_email_index
 `
 	fmt.Println(SqlMonitor.parseTable(sql))
 }
+
+func TestParseTableWithoutFixName(t *testing.T) {
+	tables, op, err := (&sqlMonitor{}).parseTable("select * from t_user where id = 1")
+	if err != nil || op != Select || len(tables) != 1 || tables[0] != "t_user" {
+		t.Errorf("parseTable = %v, %v, %v", tables, op, err)
+	}
+}
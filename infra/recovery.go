@@ -0,0 +1,50 @@
+package infra
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+func init() {
+	MetricsReg.MustRegister(serverPanicCounter)
+}
+
+var serverPanicCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "server_panics_total",
+}, []string{"api"})
+
+// RecoveryMiddleware 把handler的panic转成500响应并记录栈，
+// 需要放在MetricMiddleware里面，比如 MetricMiddleware(RecoveryMiddleware(handler))，这样panic的请求也会记到server_handle_seconds
+func RecoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// 客户端断开时net/http用ErrAbortHandler中断响应，交给net/http处理
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			recordPanic(r, HttpMonitor.apiLabel(r, http.StatusInternalServerError), err)
+			// 已经写过响应头时只能放弃，状态码以已写的为准
+			if rw, ok := w.(interface{ Committed() bool }); !ok || !rw.Committed() {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recordPanic 记录panic的栈和server_panics_total，需要在recover的defer函数里直接调用
+func recordPanic(r *http.Request, api string, p interface{}) {
+	serverPanicCounter.WithLabelValues(api).Inc()
+	log.WithFields(withRequestFields(r.Context(), log.Fields{
+		"panic":  fmt.Sprint(p),
+		"method": r.Method,
+		"api":    api,
+		Stack:    fmt.Sprintf("%+v", callersDepth(5, 32)),
+	})).Error("panic")
+}
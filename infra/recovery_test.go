@@ -0,0 +1,62 @@
+package infra
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestRecoveryMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+	handler := MetricMiddleware(RecoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panicInHandler()
+	})))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/recover/1", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", rec.Code)
+	}
+	if v, _ := gatherValue(t, serverPanicCounter, "server_panics_total", map[string]string{"api": "/recover/:id"}); v != 1 {
+		t.Errorf("server_panics_total = %v, want 1", v)
+	}
+	if v, _ := gatherValue(t, serverHandleHistogram, "server_handle_seconds", map[string]string{"api": "/recover/:id", "status": "500"}); v != 1 {
+		t.Errorf("server_handle_seconds{status=500} count = %v, want 1", v)
+	}
+	var entry map[string]interface{}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, `"panic"`) {
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("panic log is not json: %v", err)
+			}
+			break
+		}
+	}
+	if entry["panic"] != "boom" || !strings.Contains(entry[Stack].(string), "panicInHandler") {
+		t.Fatalf("unexpected panic log: %v", entry)
+	}
+}
+
+func TestRecoveryMiddlewareRepanicsAbort(t *testing.T) {
+	handler := RecoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Fatalf("recovered %v, want http.ErrAbortHandler", err)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/recover/abort", nil))
+}
+
+func panicInHandler() {
+	panic("boom")
+}
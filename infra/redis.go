@@ -1,10 +1,15 @@
 package infra
 
 import (
+	"context"
 	"fmt"
 	"github.com/go-redis/redis"
 	log "github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -12,29 +17,110 @@ var (
 	monitorKeys = make([]string, 0, 100)
 )
 
+const defaultRedisSlowThreshold = 100 * time.Millisecond
+
 type redisMonitor struct {
+	mu sync.RWMutex
+	// 实例级别的慢命令阈值
+	slowThresholds map[string]time.Duration
+	// key前缀级别的慢命令阈值，按前缀长度从长到短排序，优先于实例级别
+	keySlowThresholds prefixDurations
+	clients           map[string]*redis.Client
+	serverCollector   *redisServerCollector
+	policies          map[string][]RedisPolicy
+	// lua脚本sha1到脚本名
+	scripts map[string]string
+	// lua脚本内容到脚本名
+	scriptBodies map[string]string
+}
+
+var RedisMonitor = &redisMonitor{
+	slowThresholds: make(map[string]time.Duration),
+	clients:        make(map[string]*redis.Client),
+	policies:       make(map[string][]RedisPolicy),
+	scripts:        make(map[string]string),
+	scriptBodies:   make(map[string]string),
+}
+
+// prefixDuration key前缀对应的时长
+type prefixDuration struct {
+	prefix   string
+	duration time.Duration
+}
+
+// prefixDurations 按前缀长度从长到短排序，多个前缀都匹配时最长的前缀生效
+type prefixDurations []prefixDuration
+
+func (p prefixDurations) set(prefix string, d time.Duration) prefixDurations {
+	for i := range p {
+		if p[i].prefix == prefix {
+			p[i].duration = d
+			return p
+		}
+	}
+	p = append(p, prefixDuration{prefix: prefix, duration: d})
+	sort.SliceStable(p, func(i, j int) bool {
+		return len(p[i].prefix) > len(p[j].prefix)
+	})
+	return p
 }
 
-var RedisMonitor = &redisMonitor{}
+func (p prefixDurations) match(key string) (prefixDuration, bool) {
+	for _, pd := range p {
+		if strings.HasPrefix(key, pd.prefix) {
+			return pd, true
+		}
+	}
+	return prefixDuration{}, false
+}
 
 func (r *redisMonitor) AddMonitorKey(keyPrefix string) {
 	monitorKeys = append(monitorKeys, keyPrefix)
 }
 
+// SetSlowThreshold 设置某个redis实例的慢命令阈值，默认100ms
+func (r *redisMonitor) SetSlowThreshold(redisInstanceName string, threshold time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.slowThresholds[redisInstanceName] = threshold
+}
+
+// SetKeySlowThreshold 设置第一个key以keyPrefix开头的命令的慢命令阈值，多个前缀都匹配时最长的前缀生效
+func (r *redisMonitor) SetKeySlowThreshold(keyPrefix string, threshold time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keySlowThresholds = r.keySlowThresholds.set(keyPrefix, threshold)
+}
+
+// slowThreshold key是命令的第一个key
+func (r *redisMonitor) slowThreshold(redisInstanceName string, key string) time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if t, ok := r.keySlowThresholds.match(key); ok {
+		return t.duration
+	}
+	if threshold, ok := r.slowThresholds[redisInstanceName]; ok {
+		return threshold
+	}
+	return defaultRedisSlowThreshold
+}
+
 func matchKey(key string) (string, bool) {
-	var (
-		matchKey string
-	)
+	matchKey, match := matchPattern(key)
+	if !match {
+		return "", false
+	}
+	return getCmdFromKey(key) + " " + matchKey, true
+}
+
+// matchPattern 返回key命中的监控前缀
+func matchPattern(key string) (string, bool) {
 	for _, k := range monitorKeys {
 		if strings.Contains(key, k) {
-			matchKey = k
-			break
+			return k, true
 		}
 	}
-	if len(matchKey) == 0 {
-		return "", false
-	}
-	return getCmdFromKey(key) + " " + matchKey, true
+	return "", false
 }
 
 func getCmdFromKey(key string) string {
@@ -45,55 +131,222 @@ func getCmdFromKey(key string) string {
 	return ""
 }
 
+func cmdArgsString(cmd redis.Cmder) string {
+	return strings.TrimSuffix(strings.TrimLeft(fmt.Sprintf("%v", cmd.Args()), "["), "]")
+}
+
 func (r *redisMonitor) AddRedisHook(client *redis.Client, redisInstanceName string) {
+	r.mu.Lock()
+	r.clients[redisInstanceName] = client
+	r.mu.Unlock()
+	if err := MetricsReg.Register(newRedisPoolCollector(client, redisInstanceName)); err != nil {
+		log.WithError(err).WithField("app", redisInstanceName).Error("register redis pool collector fail")
+	}
+	peer := peerHost(client.Options().Addr)
+
 	client.WrapProcessPipeline(func(oldProcess func([]redis.Cmder) error) func([]redis.Cmder) error {
 		return func(cmders []redis.Cmder) error {
+			for _, cmd := range cmders {
+				// pipeline里的命令拿不到拦截的错误，block规则也只记录
+				r.checkPolicy(cmd, redisInstanceName, false, 5)
+			}
 			start := time.Now()
 			for _, cmd := range cmders {
-				dealKey, match := matchKey(truncateKey(100, strings.TrimSuffix(strings.TrimLeft(fmt.Sprintf("%v", cmd.Args()), "["), "]")))
+				dealKey, match := r.redisMetricName(cmd)
 				if match {
 					MetricMonitor.RecordClientCount(TypeRedis, cmd.Name(), dealKey, redisInstanceName)
 				}
 			}
+			statements := make([]string, 0, len(cmders))
+			for _, cmd := range cmders {
+				statements = append(statements, redactRedisCmd(cmd))
+			}
+			// v6 的pipeline没有自己的ctx，RedisMonitor.WithContext 给pipeline里的每条命令绑定的是同一个ctx，取第一条的即可
+			ctx, span := TraceMonitor.startSpan(cmdContext(cmders[0]), "pipeline", trace.SpanKindClient,
+				semconv.DBSystemRedis,
+				semconv.DBStatement(truncateKey(1024, strings.Join(statements, "; "))),
+				semconv.DBOperation("pipeline"),
+				semconv.NetPeerName(peer),
+			)
 			err := oldProcess(cmders)
+			endSpan(span, spanErr(err))
+			// 和单条命令一样不统计阻塞命令，pipeline的耗时无法按命令拆分，含阻塞命令时整个不计
+			if !hasBlockingCmd(cmders) {
+				tenantUsage.addDuration(ctx, TypeRedis, time.Since(start).Seconds())
+				pipelineSlowLog(ctx, cmders, statements, start, redisInstanceName)
+			}
 			for _, cmd := range cmders {
-				cacheWrapper(cmd, start, err, redisInstanceName)
+				cacheWrapper(ctx, cmd, start, cmd.Err(), redisInstanceName, true)
 			}
+			redisTTLAuditor.audit(cmders, redisInstanceName)
 			return err
 		}
 	})
 
 	client.WrapProcess(func(oldProcess func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
 		return func(cmd redis.Cmder) error {
+			// RedisMonitor.Process已经检查过block规则，这里只记录
+			r.checkPolicy(cmd, redisInstanceName, false, 5)
 			start := time.Now()
-			dealKey, match := matchKey(truncateKey(100, strings.TrimSuffix(strings.TrimLeft(fmt.Sprintf("%v", cmd.Args()), "["), "]")))
+			dealKey, match := r.redisMetricName(cmd)
 			if match {
 				MetricMonitor.RecordClientCount(TypeRedis, cmd.Name(), dealKey, redisInstanceName)
 			}
+			ctx, span := TraceMonitor.startSpan(cmdContext(cmd), cmd.Name(), trace.SpanKindClient,
+				semconv.DBSystemRedis,
+				semconv.DBStatement(redactRedisCmd(cmd)),
+				semconv.DBOperation(cmd.Name()),
+				semconv.NetPeerName(peer),
+			)
 			err := oldProcess(cmd)
-			cacheWrapper(cmd, start, err, redisInstanceName)
+			endSpan(span, spanErr(err))
+			if !isBlockingCmd(cmd) {
+				tenantUsage.addDuration(ctx, TypeRedis, time.Since(start).Seconds())
+			}
+			cacheWrapper(ctx, cmd, start, err, redisInstanceName, false)
+			redisTTLAuditor.audit([]redis.Cmder{cmd}, redisInstanceName)
 			return err
 		}
 	})
 
 }
 
-func cacheWrapper(cmd redis.Cmder, start time.Time, err error, app string) {
-	key := strings.TrimSuffix(strings.TrimLeft(fmt.Sprintf("%v", cmd.Args()), "["), "]")
-	key = truncateKey(100, key)
-	now := time.Now()
+// cacheWrapper 记录单条命令的指标和日志，pipelined为true时cost是整个pipeline的耗时，不按命令记录耗时和慢日志
+func cacheWrapper(ctx context.Context, cmd redis.Cmder, start time.Time, err error, app string, pipelined bool) {
+	key := truncateKey(100, cmdArgsString(cmd))
+	cost := time.Since(start)
 
-	dealKey, match := matchKey(truncateKey(100, strings.TrimSuffix(strings.TrimLeft(fmt.Sprintf("%v", cmd.Args()), "["), "]")))
-	if match {
-		MetricMonitor.RecordClientHandlerSeconds(TypeRedis, cmd.Name(), dealKey, app, float64(now.UnixNano()/1000000-start.UnixNano()/1000000)/1000)
+	blocking := isBlockingCmd(cmd)
+	dealKey, match := RedisMonitor.redisMetricName(cmd)
+	switch {
+	case pipelined:
+		// pipeline的耗时不能按命令拆分
+	case blocking:
+		recordBlockingWait(cmd, app, cost)
+	case match:
+		MetricMonitor.RecordClientHandlerSecondsContext(ctx, TypeRedis, cmd.Name(), dealKey, app, cost.Seconds())
+	}
+	if isScriptCmd(cmd) {
+		RedisMonitor.recordScriptCall(cmd, app)
+	}
+	RedisMonitor.recordCacheResult(ctx, cmd, app)
+	redisStampedeDetector.onWrite(cmd, app)
+	if !pipelined && !blocking && cost >= RedisMonitor.slowThreshold(app, firstKey(cmd)) {
+		name := dealKey
+		if !match {
+			name = cmd.Name() + " other"
+		}
+		MetricMonitor.RecordClientSlowCount(TypeRedis, cmd.Name(), name, app)
+		data := log.Fields{
+			Cost:        cost.Milliseconds(),
+			MetricType:  "slowLog",
+			"app":       app,
+			"name":      cmd.Name(),
+			"key":       truncateKey(100, firstKey(cmd)),
+			"args":      truncateKey(1024, cmdArgsString(cmd)),
+			"replySize": replySize(cmd),
+			Stack:       fmt.Sprintf("%+v", callersDepth(4, 5)),
+		}
+		log.WithFields(withRequestFields(ctx, data)).Errorf("redisslowlog")
 	}
 	if err != nil && err != redis.Nil {
+		class := classifyRedisError(err)
+		recordRedisError(app, cmd.Name(), class)
 		fields := log.Fields{
 			"app":      app,
 			"key":      key,
 			"name":     cmd.Name(),
-			"duration": time.Since(now).String(),
+			"duration": cost.String(),
+			"errClass": class,
+		}
+		log.WithError(err).WithFields(withRequestFields(ctx, fields)).Error("rediserrlog")
+	}
+}
+
+// pipelineSlowLog 整个pipeline只记一条慢日志，阈值取各命令阈值中最大的，
+// 避免为bigkey调大阈值的命令和其他命令放在一起时被误报
+func pipelineSlowLog(ctx context.Context, cmders []redis.Cmder, statements []string, start time.Time, app string) {
+	cost := time.Since(start)
+	var threshold time.Duration
+	for _, cmd := range cmders {
+		if t := RedisMonitor.slowThreshold(app, firstKey(cmd)); t > threshold {
+			threshold = t
+		}
+	}
+	if cost < threshold {
+		return
+	}
+	MetricMonitor.RecordClientSlowCount(TypeRedis, "pipeline", "pipeline", app)
+	data := log.Fields{
+		Cost:       cost.Milliseconds(),
+		MetricType: "slowLog",
+		"app":      app,
+		"name":     "pipeline",
+		"cmds":     len(cmders),
+		"args":     truncateKey(1024, strings.Join(statements, "; ")),
+		Stack:      fmt.Sprintf("%+v", callersDepth(4, 5)),
+	}
+	log.WithFields(withRequestFields(ctx, data)).Errorf("redisslowlog")
+}
+
+// spanErr redis.Nil 只是key不存在，不算失败
+func spanErr(err error) error {
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
+
+// firstKey 返回命令的第一个key，EVAL/EVALSHA的第一个参数是脚本，取KEYS的第一个
+func firstKey(cmd redis.Cmder) string {
+	if isScriptCmd(cmd) {
+		if keys := scriptKeys(cmd); len(keys) > 0 {
+			return keys[0]
+		}
+		return ""
+	}
+	args := cmd.Args()
+	if len(args) < 2 {
+		return ""
+	}
+	return fmt.Sprint(args[1])
+}
+
+// replySize 估算命令返回值的字节数
+func replySize(cmd redis.Cmder) int {
+	size := 0
+	switch c := cmd.(type) {
+	case *redis.StringCmd:
+		size = len(c.Val())
+	case *redis.StringSliceCmd:
+		for _, v := range c.Val() {
+			size += len(v)
+		}
+	case *redis.StringStringMapCmd:
+		for k, v := range c.Val() {
+			size += len(k) + len(v)
+		}
+	case *redis.ZSliceCmd:
+		for _, z := range c.Val() {
+			size += len(fmt.Sprint(z.Member)) + 8
+		}
+	case *redis.SliceCmd:
+		for _, v := range c.Val() {
+			if s, ok := v.(string); ok {
+				size += len(s)
+			}
+		}
+	case *redis.Cmd:
+		switch v := c.Val().(type) {
+		case string:
+			size = len(v)
+		case []interface{}:
+			for _, e := range v {
+				if s, ok := e.(string); ok {
+					size += len(s)
+				}
+			}
 		}
-		log.WithError(err).WithFields(fields).Error("rediserrlog")
 	}
+	return size
 }
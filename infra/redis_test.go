@@ -0,0 +1,96 @@
+package infra
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestRedisKeySlowThreshold(t *testing.T) {
+	r := &redisMonitor{slowThresholds: map[string]time.Duration{"slowcfg": 50 * time.Millisecond}}
+	r.SetKeySlowThreshold("user:", time.Second)
+	r.SetKeySlowThreshold("user:feed:", 5*time.Second)
+	r.SetKeySlowThreshold("u", 2*time.Second)
+	r.SetKeySlowThreshold("user:", 3*time.Second)
+
+	cases := []struct {
+		app  string
+		key  string
+		want time.Duration
+	}{
+		{"slowcfg", "user:feed:1", 5 * time.Second},
+		{"slowcfg", "user:1", 3 * time.Second},
+		{"slowcfg", "uid:1", 2 * time.Second},
+		// 只按前缀匹配，不匹配key中间的内容
+		{"slowcfg", "order:user:1", 50 * time.Millisecond},
+		{"other", "order:1", defaultRedisSlowThreshold},
+	}
+	for _, tc := range cases {
+		if got := r.slowThreshold(tc.app, tc.key); got != tc.want {
+			t.Errorf("slowThreshold(%s, %s) = %v, want %v", tc.app, tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestRedisSlowLogUsesFirstKey(t *testing.T) {
+	server := newFakeRedis(t, func(args []string) string { return "+OK\r\n" })
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	RedisMonitor.AddRedisHook(client, "slowkey")
+	RedisMonitor.SetKeySlowThreshold("slowkey:", -1)
+
+	var buf bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+
+	// 参数里包含前缀但第一个key不匹配，不算慢命令
+	client.Set("fastkey:1", "slowkey:value", 0)
+	if strings.Contains(buf.String(), "redisslowlog") {
+		t.Fatalf("value matched the key prefix: %s", buf.String())
+	}
+	client.Set("slowkey:1", "v", 0)
+	if !strings.Contains(buf.String(), "redisslowlog") || !strings.Contains(buf.String(), `"key":"slowkey:1"`) {
+		t.Errorf("slow log missing: %s", buf.String())
+	}
+}
+
+func TestRedisPipelineSingleSlowLog(t *testing.T) {
+	server := newFakeRedis(t, func(args []string) string { return "+OK\r\n" })
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	RedisMonitor.AddRedisHook(client, "slowpipe")
+	RedisMonitor.SetSlowThreshold("slowpipe", -1)
+
+	var buf bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+
+	slow := func(op string) float64 {
+		v, _ := gatherValue(t, clientSlowCounter, "client_slow_total", map[string]string{"type": TypeRedis, "op": op, "peer": "slowpipe"})
+		return v
+	}
+	pipelineBefore, setBefore := slow("pipeline"), slow("set")
+	if _, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set("pipe:1", "v", 0)
+		pipe.Set("pipe:2", "v", 0)
+		pipe.Set("pipe:3", "v", 0)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "redisslowlog"); n != 1 || !strings.Contains(buf.String(), `"cmds":3`) {
+		t.Errorf("%d slow logs for one pipeline: %s", n, buf.String())
+	}
+	if got := slow("pipeline") - pipelineBefore; got != 1 {
+		t.Errorf("pipeline slow count = %v, want 1", got)
+	}
+	if got := slow("set") - setBefore; got != 0 {
+		t.Errorf("per-command slow count = %v, want 0", got)
+	}
+}
@@ -0,0 +1,179 @@
+package infra
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	MetricsReg.MustRegister(redisBlockingHistogram, redisPubSubMessageCounter, redisPubSubGauge, redisPubSubReconnectCounter)
+}
+
+var (
+	redisBlockingHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "redis_blocking_wait_seconds",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"instance", "cmd"})
+
+	redisPubSubMessageCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_pubsub_messages_total",
+	}, []string{"instance", "pattern"})
+
+	redisPubSubGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "redis_pubsub_subscriptions",
+	}, []string{"instance"})
+
+	redisPubSubReconnectCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_pubsub_reconnects_total",
+	}, []string{"instance"})
+)
+
+// 会阻塞等待的命令，耗时不计入client_handle_seconds
+var blockingCmds = map[string]bool{
+	"blpop":      true,
+	"brpop":      true,
+	"brpoplpush": true,
+	"blmove":     true,
+	"blmpop":     true,
+	"bzpopmin":   true,
+	"bzpopmax":   true,
+	"bzmpop":     true,
+	"wait":       true,
+	"waitaof":    true,
+}
+
+func isBlockingCmd(cmd redis.Cmder) bool {
+	name := cmd.Name()
+	if blockingCmds[name] {
+		return true
+	}
+	if name != "xread" && name != "xreadgroup" {
+		return false
+	}
+	for _, arg := range cmd.Args()[1:] {
+		if strings.EqualFold(fmt.Sprint(arg), "block") {
+			return true
+		}
+	}
+	return false
+}
+
+func hasBlockingCmd(cmders []redis.Cmder) bool {
+	for _, cmd := range cmders {
+		if isBlockingCmd(cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+func recordBlockingWait(cmd redis.Cmder, app string, cost time.Duration) {
+	redisBlockingHistogram.With(prometheus.Labels{
+		"instance": app,
+		"cmd":      cmd.Name(),
+	}).Observe(cost.Seconds())
+}
+
+// MonitoredPubSub 由MonitorPubSub返回，Channel()用法和pubsub.Channel()一致，需要用它的Close关闭
+type MonitoredPubSub struct {
+	*redis.PubSub
+	ch   chan *redis.Message
+	done chan struct{}
+	once sync.Once
+}
+
+// Channel 返回接收消息的channel，Close后关闭
+func (p *MonitoredPubSub) Channel() <-chan *redis.Message {
+	return p.ch
+}
+
+// Close 停止接收并关闭pubsub
+func (p *MonitoredPubSub) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return p.PubSub.Close()
+}
+
+func (p *MonitoredPubSub) closed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// MonitorPubSub 接管pubsub的消息接收，统计消息数、订阅数和重连次数
+func (r *redisMonitor) MonitorPubSub(pubsub *redis.PubSub, redisInstanceName string) *MonitoredPubSub {
+	p := &MonitoredPubSub{
+		PubSub: pubsub,
+		ch:     make(chan *redis.Message, 100),
+		done:   make(chan struct{}),
+	}
+	subscriptions := redisPubSubGauge.WithLabelValues(redisInstanceName)
+	go func() {
+		var (
+			errCount int
+			count    int
+		)
+		defer func() {
+			subscriptions.Sub(float64(count))
+			close(p.ch)
+		}()
+		for {
+			msg, err := pubsub.Receive()
+			if err != nil {
+				if p.closed() {
+					return
+				}
+				// 连接出错后下一次Receive会重连并重新订阅
+				if errCount == 0 {
+					log.WithError(err).WithField("app", redisInstanceName).Warn("redis pubsub receive fail")
+				}
+				errCount++
+				backoff := time.Duration(errCount) * 100 * time.Millisecond
+				if backoff > time.Second {
+					backoff = time.Second
+				}
+				select {
+				case <-p.done:
+					return
+				case <-time.After(backoff):
+				}
+				continue
+			}
+			if errCount > 0 {
+				redisPubSubReconnectCounter.WithLabelValues(redisInstanceName).Inc()
+				log.WithField("app", redisInstanceName).Infof("redis pubsub reconnected after %d errors", errCount)
+				errCount = 0
+			}
+			switch msg := msg.(type) {
+			case *redis.Subscription:
+				subscriptions.Add(float64(msg.Count - count))
+				count = msg.Count
+			case *redis.Message:
+				pattern := msg.Pattern
+				if pattern == "" {
+					var match bool
+					if pattern, match = matchPattern(msg.Channel); !match {
+						pattern = "other"
+					}
+				}
+				redisPubSubMessageCounter.With(prometheus.Labels{
+					"instance": redisInstanceName,
+					"pattern":  pattern,
+				}).Inc()
+				select {
+				case p.ch <- msg:
+				case <-p.done:
+					return
+				}
+			}
+		}
+	}()
+	return p
+}
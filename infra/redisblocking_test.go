@@ -0,0 +1,141 @@
+package infra
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+func TestIsBlockingCmd(t *testing.T) {
+	cases := []struct {
+		cmd  redis.Cmder
+		want bool
+	}{
+		{redis.NewStringSliceCmd("blpop", "q", 0), true},
+		{redis.NewStringSliceCmd("brpop", "q", 0), true},
+		{redis.NewStringCmd("brpoplpush", "a", "b", 0), true},
+		{redis.NewZWithKeyCmd("bzpopmin", "z", 0), true},
+		{redis.NewIntCmd("wait", 1, 0), true},
+		{redis.NewXStreamSliceCmd("xread", "block", 0, "streams", "s", "$"), true},
+		{redis.NewXStreamSliceCmd("xreadgroup", "group", "g", "c", "BLOCK", 100, "streams", "s", ">"), true},
+		{redis.NewXStreamSliceCmd("xread", "count", 1, "streams", "s", "0"), false},
+		{redis.NewStringSliceCmd("lpop", "q"), false},
+		{redis.NewStringCmd("get", "block"), false},
+	}
+	for _, tc := range cases {
+		if got := isBlockingCmd(tc.cmd); got != tc.want {
+			t.Errorf("isBlockingCmd(%v) = %v, want %v", tc.cmd.Args(), got, tc.want)
+		}
+	}
+}
+
+func TestBlockingWaitSeparated(t *testing.T) {
+	server := newFakeRedis(t, func(args []string) string {
+		if args[0] == "blpop" {
+			time.Sleep(20 * time.Millisecond)
+			return "*-1\r\n"
+		}
+		return "+OK\r\n"
+	})
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	RedisMonitor.AddRedisHook(client, "blocking")
+	RedisMonitor.AddMonitorKey("blockq")
+
+	labels := map[string]string{"instance": "blocking", "cmd": "blpop"}
+	before, _ := gatherValue(t, redisBlockingHistogram, "redis_blocking_wait_seconds", labels)
+	client.BLPop(time.Second, "blockq:1")
+	if v, _ := gatherValue(t, redisBlockingHistogram, "redis_blocking_wait_seconds", labels); v-before != 1 {
+		t.Errorf("redis_blocking_wait_seconds count = %v, want 1", v)
+	}
+	if _, ok := gatherValue(t, clientHandleHistogram, "client_handle_seconds", map[string]string{"peer": "blocking", "op": "blpop"}); ok {
+		t.Error("blocking command recorded in client_handle_seconds")
+	}
+
+	labels["cmd"] = "brpop"
+	before, _ = gatherValue(t, redisBlockingHistogram, "redis_blocking_wait_seconds", labels)
+	recordBlockingWait(redis.NewStringSliceCmd("brpop", "q", 0), "blocking", time.Second)
+	if v, _ := gatherValue(t, redisBlockingHistogram, "redis_blocking_wait_seconds", labels); v-before != 1 {
+		t.Errorf("recordBlockingWait count = %v, want 1", v)
+	}
+}
+
+// pubsubServer 第一个连接推送一条消息后断开，之后的连接推送一条消息后保持
+func pubsubServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn, first bool) {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				if _, err := readRESPCommand(rd); err != nil {
+					return
+				}
+				io.WriteString(conn, respArray(respBulk("subscribe"), respBulk("psnews:1"), respInt(1))+
+					respArray(respBulk("message"), respBulk("psnews:1"), respBulk("hello")))
+				if first {
+					return
+				}
+				io.Copy(io.Discard, rd)
+			}(conn, i == 0)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestMonitorPubSub(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: pubsubServer(t)})
+	defer client.Close()
+	RedisMonitor.AddMonitorKey("psnews:")
+
+	labels := map[string]string{"instance": "pubsub"}
+	reconnects, _ := gatherValue(t, redisPubSubReconnectCounter, "redis_pubsub_reconnects_total", labels)
+	messages, _ := gatherValue(t, redisPubSubMessageCounter, "redis_pubsub_messages_total", map[string]string{"instance": "pubsub", "pattern": "psnews:"})
+	pubsub := RedisMonitor.MonitorPubSub(client.Subscribe("psnews:1"), "pubsub")
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-pubsub.Channel():
+			if msg.Payload != "hello" {
+				t.Fatalf("payload = %q", msg.Payload)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("message %d not received", i)
+		}
+	}
+	if v, _ := gatherValue(t, redisPubSubReconnectCounter, "redis_pubsub_reconnects_total", labels); v-reconnects != 1 {
+		t.Errorf("redis_pubsub_reconnects_total = %v, want 1", v)
+	}
+	if v, _ := gatherValue(t, redisPubSubGauge, "redis_pubsub_subscriptions", labels); v != 1 {
+		t.Errorf("redis_pubsub_subscriptions = %v, want 1", v)
+	}
+	labels["pattern"] = "psnews:"
+	if v, _ := gatherValue(t, redisPubSubMessageCounter, "redis_pubsub_messages_total", labels); v-messages != 2 {
+		t.Errorf("redis_pubsub_messages_total = %v, want 2", v)
+	}
+
+	pubsub.Close()
+	select {
+	case _, ok := <-pubsub.Channel():
+		if ok {
+			t.Fatal("unexpected message after Close")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("channel not closed after Close")
+	}
+	delete(labels, "pattern")
+	if v, _ := gatherValue(t, redisPubSubGauge, "redis_pubsub_subscriptions", labels); v != 0 {
+		t.Errorf("redis_pubsub_subscriptions after Close = %v, want 0", v)
+	}
+}
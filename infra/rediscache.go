@@ -0,0 +1,169 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+)
+
+func init() {
+	MetricsReg.MustRegister(cacheRequestCounter)
+}
+
+const (
+	cacheHit  = "hit"
+	cacheMiss = "miss"
+	// 多个pattern的EXISTS部分命中时无法确定每个key的结果
+	cacheUnknown = "unknown"
+)
+
+var (
+	cacheRequestCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_requests_total",
+	}, []string{"instance", "pattern", "result"})
+)
+
+// 单key读命令，返回redis.Nil即为未命中
+var singleKeyReadCmds = map[string]bool{
+	"get":      true,
+	"hget":     true,
+	"zscore":   true,
+	"zrank":    true,
+	"zrevrank": true,
+	"lindex":   true,
+}
+
+func (r *redisMonitor) recordCacheResult(ctx context.Context, cmd redis.Cmder, app string) {
+	err := cmd.Err()
+	if err != nil && err != redis.Nil {
+		return
+	}
+	args := cmd.Args()
+	if len(args) < 2 {
+		return
+	}
+	name := strings.ToLower(cmd.Name())
+	switch {
+	case singleKeyReadCmds[name]:
+		result := cacheHit
+		if err == redis.Nil {
+			result = cacheMiss
+		}
+		recordCacheRequest(ctx, app, fmt.Sprint(args[1]), result, 1)
+	case name == "mget":
+		c, ok := cmd.(*redis.SliceCmd)
+		if !ok {
+			return
+		}
+		// 多key命令每个key单独统计
+		for i, v := range c.Val() {
+			if i+1 >= len(args) {
+				break
+			}
+			recordCacheRequest(ctx, app, fmt.Sprint(args[i+1]), valueResult(v), 1)
+		}
+	case name == "hmget":
+		c, ok := cmd.(*redis.SliceCmd)
+		if !ok {
+			return
+		}
+		key := fmt.Sprint(args[1])
+		for _, v := range c.Val() {
+			recordCacheRequest(ctx, app, key, valueResult(v), 1)
+		}
+	case name == "exists":
+		c, ok := cmd.(*redis.IntCmd)
+		if !ok {
+			return
+		}
+		recordExistsResult(ctx, app, args[1:], int(c.Val()))
+	case name == "hexists" || name == "sismember":
+		c, ok := cmd.(*redis.BoolCmd)
+		if !ok {
+			return
+		}
+		result := cacheMiss
+		if c.Val() {
+			result = cacheHit
+		}
+		recordCacheRequest(ctx, app, fmt.Sprint(args[1]), result, 1)
+	case name == "hgetall":
+		c, ok := cmd.(*redis.StringStringMapCmd)
+		if !ok {
+			return
+		}
+		result := cacheMiss
+		if len(c.Val()) > 0 {
+			result = cacheHit
+		}
+		recordCacheRequest(ctx, app, fmt.Sprint(args[1]), result, 1)
+	}
+}
+
+// recordExistsResult EXISTS只返回存在的个数，每个key按自己的pattern统计:
+// 全部命中或全部未命中时结果是确定的，部分命中且key都属于同一个pattern时按个数统计，否则记为unknown
+func recordExistsResult(ctx context.Context, app string, args []interface{}, hits int) {
+	keys := make([]string, 0, len(args))
+	patterns := make(map[string]bool)
+	for _, arg := range args {
+		key := fmt.Sprint(arg)
+		keys = append(keys, key)
+		patterns[keyPattern(key)] = true
+	}
+	switch {
+	case hits <= 0 || hits >= len(keys):
+		result := cacheMiss
+		if hits > 0 {
+			result = cacheHit
+		}
+		for _, key := range keys {
+			recordCacheRequest(ctx, app, key, result, 1)
+		}
+	case len(patterns) == 1:
+		pattern := keyPattern(keys[0])
+		recordCachePattern(app, pattern, cacheHit, hits)
+		recordCachePattern(app, pattern, cacheMiss, len(keys)-hits)
+	default:
+		for _, key := range keys {
+			recordCachePattern(app, keyPattern(key), cacheUnknown, 1)
+		}
+	}
+}
+
+func valueResult(v interface{}) string {
+	if v == nil {
+		return cacheMiss
+	}
+	return cacheHit
+}
+
+func recordCacheRequest(ctx context.Context, app string, key string, result string, count int) {
+	if count <= 0 {
+		return
+	}
+	if result == cacheMiss {
+		redisStampedeDetector.onMiss(ctx, app, key)
+	}
+	recordCachePattern(app, keyPattern(key), result, count)
+}
+
+func keyPattern(key string) string {
+	pattern, match := matchPattern(key)
+	if !match {
+		return "other"
+	}
+	return pattern
+}
+
+func recordCachePattern(app string, pattern string, result string, count int) {
+	if count <= 0 {
+		return
+	}
+	cacheRequestCounter.With(prometheus.Labels{
+		"instance": app,
+		"pattern":  pattern,
+		"result":   result,
+	}).Add(float64(count))
+}
@@ -0,0 +1,74 @@
+package infra
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+func TestCacheHitMissPerPattern(t *testing.T) {
+	values := map[string]string{"chuser:1": "a", "chfeed:1": "b"}
+	server := newFakeRedis(t, func(args []string) string {
+		switch strings.ToLower(args[0]) {
+		case "get":
+			if v, ok := values[args[1]]; ok {
+				return respBulk(v)
+			}
+			return "$-1\r\n"
+		case "mget":
+			items := make([]string, 0, len(args)-1)
+			for _, key := range args[1:] {
+				if v, ok := values[key]; ok {
+					items = append(items, respBulk(v))
+				} else {
+					items = append(items, "$-1\r\n")
+				}
+			}
+			return respArray(items...)
+		case "exists":
+			n := 0
+			for _, key := range args[1:] {
+				if _, ok := values[key]; ok {
+					n++
+				}
+			}
+			return respInt(int64(n))
+		}
+		return "-ERR unknown command\r\n"
+	})
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	RedisMonitor.AddRedisHook(client, "cache")
+	RedisMonitor.AddMonitorKey("chuser:")
+	RedisMonitor.AddMonitorKey("chfeed:")
+
+	client.Get("chuser:1")
+	client.Get("chuser:2")
+	client.MGet("chuser:1", "chfeed:1", "chfeed:2")
+	// 全部未命中，每个key按自己的pattern统计
+	client.Exists("chuser:3", "chfeed:3")
+	// 同一个pattern部分命中，按个数统计
+	client.Exists("chfeed:1", "chfeed:4", "chfeed:5")
+	// 不同pattern部分命中，无法确定哪个key命中
+	client.Exists("chuser:1", "chfeed:6")
+
+	cases := []struct {
+		pattern string
+		result  string
+		want    float64
+	}{
+		{"chuser:", cacheHit, 2},
+		{"chuser:", cacheMiss, 2},
+		{"chuser:", cacheUnknown, 1},
+		{"chfeed:", cacheHit, 2},
+		{"chfeed:", cacheMiss, 4},
+		{"chfeed:", cacheUnknown, 1},
+	}
+	for _, tc := range cases {
+		labels := map[string]string{"instance": "cache", "pattern": tc.pattern, "result": tc.result}
+		if v, _ := gatherValue(t, cacheRequestCounter, "cache_requests_total", labels); v != tc.want {
+			t.Errorf("cache_requests_total%v = %v, want %v", labels, v, tc.want)
+		}
+	}
+}
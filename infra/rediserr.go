@@ -0,0 +1,78 @@
+package infra
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+func init() {
+	MetricsReg.MustRegister(redisErrorCounter)
+}
+
+// redis错误分类，wrongtype和noscript一般是代码bug，其余多为基础设施问题
+const (
+	RedisErrTimeout       = "timeout"
+	RedisErrConn          = "conn"
+	RedisErrPoolExhausted = "pool_exhausted"
+	RedisErrRedirect      = "redirect"
+	RedisErrLoading       = "loading"
+	RedisErrReadonly      = "readonly"
+	RedisErrOOM           = "oom"
+	RedisErrNoScript      = "noscript"
+	RedisErrWrongType     = "wrongtype"
+	RedisErrOther         = "other"
+)
+
+var (
+	redisErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_errors_total",
+	}, []string{"instance", "cmd", "class"})
+)
+
+var redisErrPrefixes = []struct {
+	prefix string
+	class  string
+}{
+	{"MOVED ", RedisErrRedirect},
+	{"ASK ", RedisErrRedirect},
+	{"LOADING", RedisErrLoading},
+	{"READONLY", RedisErrReadonly},
+	{"OOM", RedisErrOOM},
+	{"NOSCRIPT", RedisErrNoScript},
+	{"WRONGTYPE", RedisErrWrongType},
+}
+
+func classifyRedisError(err error) string {
+	msg := err.Error()
+	// go-redis 的 pool.ErrPoolTimeout 在internal包里，只能按错误信息判断
+	if msg == "redis: connection pool timeout" {
+		return RedisErrPoolExhausted
+	}
+	for _, p := range redisErrPrefixes {
+		if strings.HasPrefix(msg, p.prefix) {
+			return p.class
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return RedisErrTimeout
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		msg == "redis: client is closed" {
+		return RedisErrConn
+	}
+	return RedisErrOther
+}
+
+func recordRedisError(app string, cmd string, class string) {
+	redisErrorCounter.With(prometheus.Labels{
+		"instance": app,
+		"cmd":      cmd,
+		"class":    class,
+	}).Inc()
+}
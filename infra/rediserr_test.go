@@ -0,0 +1,38 @@
+package infra
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+func TestClassifyRedisError(t *testing.T) {
+	cases := []struct {
+		err   error
+		class string
+	}{
+		{errors.New("redis: connection pool timeout"), RedisErrPoolExhausted},
+		{redis.Nil, RedisErrOther},
+		{errors.New("MOVED 3999 127.0.0.1:6381"), RedisErrRedirect},
+		{errors.New("ASK 3999 127.0.0.1:6381"), RedisErrRedirect},
+		{errors.New("LOADING Redis is loading the dataset in memory"), RedisErrLoading},
+		{errors.New("READONLY You can't write against a read only replica."), RedisErrReadonly},
+		{errors.New("OOM command not allowed when used memory > 'maxmemory'."), RedisErrOOM},
+		{errors.New("NOSCRIPT No matching script. Please use EVAL."), RedisErrNoScript},
+		{errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"), RedisErrWrongType},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, RedisErrTimeout},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, RedisErrConn},
+		{io.EOF, RedisErrConn},
+		{errors.New("ERR syntax error"), RedisErrOther},
+	}
+	for _, c := range cases {
+		if class := classifyRedisError(c.err); class != c.class {
+			t.Errorf("classifyRedisError(%q) = %s, want %s", c.err, class, c.class)
+		}
+	}
+}
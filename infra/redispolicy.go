@@ -0,0 +1,142 @@
+package infra
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+func init() {
+	MetricsReg.MustRegister(redisPolicyCounter)
+}
+
+type RedisPolicyAction string
+
+const (
+	RedisPolicyWarn  RedisPolicyAction = "warn"
+	RedisPolicyBlock RedisPolicyAction = "block"
+	// redisPolicyUnenforced block规则匹配了没有经过RedisMonitor.Process的命令，只记录不拦截
+	redisPolicyUnenforced RedisPolicyAction = "unenforced"
+)
+
+var (
+	redisPolicyCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_policy_total",
+	}, []string{"instance", "cmd", "policy", "action"})
+)
+
+// RedisPolicy 描述一条危险命令规则，Commands、KeyPattern、MaxArgs 同时满足时生效。
+// block规则只对 RedisMonitor.Process 执行的命令拦截，client.Keys、pipeline 这类调用
+// 拿不到拦截的错误(go-redis v6 不能从外部设置cmd的错误)，命中block规则时只按unenforced记录日志和指标
+type RedisPolicy struct {
+	Name string
+	// 命令名，为空表示匹配所有命令
+	Commands []string
+	// 第一个key包含KeyPattern时匹配，EVAL/EVALSHA取KEYS的第一个，为空表示匹配所有key
+	KeyPattern string
+	// 参数个数(不含命令名)超过MaxArgs时匹配，0表示不限制
+	MaxArgs int
+	Action  RedisPolicyAction
+}
+
+// RedisBlockedError RedisMonitor.Process 执行的命令被RedisPolicy拦截时返回的错误，cmd.Err() 仍然是nil
+type RedisBlockedError struct {
+	Instance string
+	Cmd      string
+	Policy   string
+}
+
+func (e *RedisBlockedError) Error() string {
+	return fmt.Sprintf("redis: %s on %s blocked by policy %s", e.Cmd, e.Instance, e.Policy)
+}
+
+// AddPolicy 给redis实例添加危险命令规则
+func (r *redisMonitor) AddPolicy(redisInstanceName string, policy RedisPolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.policies[redisInstanceName] = append(r.policies[redisInstanceName], policy)
+}
+
+func (p *RedisPolicy) match(cmd redis.Cmder) bool {
+	if len(p.Commands) > 0 {
+		found := false
+		for _, c := range p.Commands {
+			if strings.EqualFold(c, cmd.Name()) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if p.KeyPattern != "" && !strings.Contains(firstKey(cmd), p.KeyPattern) {
+		return false
+	}
+	if p.MaxArgs > 0 && len(cmd.Args())-1 <= p.MaxArgs {
+		return false
+	}
+	return true
+}
+
+// Process 检查block规则之后用AddRedisHook注册的client执行命令，被拦截时返回RedisBlockedError，命令不会发到redis。
+// 需要拦截危险命令的地方要用这个方法，并且检查返回的错误
+func (r *redisMonitor) Process(redisInstanceName string, cmd redis.Cmder) error {
+	r.mu.RLock()
+	client := r.clients[redisInstanceName]
+	r.mu.RUnlock()
+	if client == nil {
+		return fmt.Errorf("redis: instance %s has no hook", redisInstanceName)
+	}
+	if err := r.checkPolicy(cmd, redisInstanceName, true, 4); err != nil {
+		return err
+	}
+	// warn规则和没拦截的命令在hook里记录
+	return client.Process(cmd)
+}
+
+// checkPolicy 对命令执行规则检查。enforce为true时只检查block规则并返回拦截的错误，
+// 否则warn规则和block规则都只记录。skip是日志里的栈要跳过的层数
+func (r *redisMonitor) checkPolicy(cmd redis.Cmder, app string, enforce bool, skip int) error {
+	r.mu.RLock()
+	policies := r.policies[app]
+	r.mu.RUnlock()
+	for i := range policies {
+		policy := &policies[i]
+		if enforce && policy.Action != RedisPolicyBlock || !policy.match(cmd) {
+			continue
+		}
+		action := policy.Action
+		if !enforce && action == RedisPolicyBlock {
+			action = redisPolicyUnenforced
+		}
+		redisPolicyCounter.With(prometheus.Labels{
+			"instance": app,
+			"cmd":      cmd.Name(),
+			"policy":   policy.Name,
+			"action":   string(action),
+		}).Inc()
+		data := log.Fields{
+			MetricType: "redisPolicy",
+			"app":      app,
+			"name":     cmd.Name(),
+			"args":     truncateKey(1024, cmdArgsString(cmd)),
+			"policy":   policy.Name,
+			"action":   action,
+			Stack:      fmt.Sprintf("%+v", callersDepth(skip, 5)),
+		}
+		data = withRequestFields(cmdContext(cmd), data)
+		switch action {
+		case RedisPolicyBlock:
+			log.WithFields(data).Error("redisPolicyBlock")
+			return &RedisBlockedError{Instance: app, Cmd: cmd.Name(), Policy: policy.Name}
+		case redisPolicyUnenforced:
+			log.WithFields(data).Error("redisPolicyUnenforced")
+		default:
+			log.WithFields(data).Warn("redisPolicyWarn")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package infra
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+func TestRedisPolicy(t *testing.T) {
+	var received int32
+	server := newFakeRedis(t, func(args []string) string {
+		atomic.AddInt32(&received, 1)
+		switch strings.ToLower(args[0]) {
+		case "del":
+			return respInt(int64(len(args) - 1))
+		case "keys":
+			return respArray(respBulk("a"))
+		}
+		return "+OK\r\n"
+	})
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	RedisMonitor.AddRedisHook(client, "policy")
+	RedisMonitor.AddPolicy("policy", RedisPolicy{Name: "no-keys", Commands: []string{"KEYS", "FLUSHALL"}, Action: RedisPolicyBlock})
+	RedisMonitor.AddPolicy("policy", RedisPolicy{Name: "big-del", Commands: []string{"del"}, MaxArgs: 2, Action: RedisPolicyWarn})
+
+	err := RedisMonitor.Process("policy", redis.NewStringSliceCmd("keys", "*"))
+	var blocked *RedisBlockedError
+	if !errors.As(err, &blocked) || blocked.Policy != "no-keys" || blocked.Cmd != "keys" {
+		t.Fatalf("Process keys error = %v, want RedisBlockedError", err)
+	}
+	if n := atomic.LoadInt32(&received); n != 0 {
+		t.Fatalf("blocked command reached the server %d times", n)
+	}
+	set := redis.NewStatusCmd("set", "a", "1")
+	if err := RedisMonitor.Process("policy", set); err != nil || set.Val() != "OK" {
+		t.Fatalf("Process set = %q, %v", set.Val(), err)
+	}
+	if err := RedisMonitor.Process("nohook", redis.NewStatusCmd("ping")); err == nil {
+		t.Error("Process on an instance without hook returned nil")
+	}
+
+	// 拿不到错误的调用不拦截，按unenforced记录
+	if keys, err := client.Keys("*").Result(); err != nil || len(keys) != 1 {
+		t.Fatalf("Keys = %v, %v", keys, err)
+	}
+	if _, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set("a", "1", 0)
+		pipe.FlushAll()
+		return nil
+	}); err != nil {
+		t.Fatalf("pipeline error = %v", err)
+	}
+	if n := atomic.LoadInt32(&received); n != 4 {
+		t.Errorf("server received %d commands, want 4", n)
+	}
+	if v, _ := gatherValue(t, redisPolicyCounter, "redis_policy_total", map[string]string{"instance": "policy", "policy": "no-keys", "action": "block"}); v != 1 {
+		t.Errorf("block counter = %v, want 1", v)
+	}
+	for _, cmd := range []string{"keys", "flushall"} {
+		if v, _ := gatherValue(t, redisPolicyCounter, "redis_policy_total", map[string]string{"instance": "policy", "cmd": cmd, "action": "unenforced"}); v != 1 {
+			t.Errorf("%s unenforced counter = %v, want 1", cmd, v)
+		}
+	}
+
+	// 经过Process的命令warn规则只记录一次
+	if err := RedisMonitor.Process("policy", redis.NewIntCmd("del", "a", "b", "c")); err != nil {
+		t.Fatalf("Process del = %v", err)
+	}
+	if n, err := client.Del("a", "b", "c").Result(); err != nil || n != 3 {
+		t.Fatalf("warned Del = %d, %v", n, err)
+	}
+	if v, _ := gatherValue(t, redisPolicyCounter, "redis_policy_total", map[string]string{"instance": "policy", "policy": "big-del", "action": "warn"}); v != 2 {
+		t.Errorf("warn counter = %v, want 2", v)
+	}
+}
+
+func TestRedisPolicyScriptKeys(t *testing.T) {
+	var received int32
+	server := newFakeRedis(t, func(args []string) string {
+		atomic.AddInt32(&received, 1)
+		return respInt(1)
+	})
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	RedisMonitor.AddRedisHook(client, "policyscript")
+	RedisMonitor.AddPolicy("policyscript", RedisPolicy{Name: "no-hot", KeyPattern: "hot:", Action: RedisPolicyBlock})
+
+	// 脚本内容里出现hot:不算匹配
+	if err := client.Eval(`return redis.call("GET", "hot:" .. KEYS[1])`, []string{"cold:1"}).Err(); err != nil {
+		t.Fatalf("eval on cold key = %v", err)
+	}
+	// 只检查第一个key
+	if err := RedisMonitor.Process("policyscript", redis.NewCmd("evalsha", "ab12", 2, "cold:2", "hot:1")); err != nil {
+		t.Errorf("evalsha with hot second key = %v", err)
+	}
+	var blocked *RedisBlockedError
+	cmd := redis.NewCmd("evalsha", "ab12", 1, "hot:1", "cold:arg")
+	if err := RedisMonitor.Process("policyscript", cmd); !errors.As(err, &blocked) || blocked.Policy != "no-hot" {
+		t.Errorf("evalsha on hot key = %v, want RedisBlockedError", err)
+	}
+	if n := atomic.LoadInt32(&received); n != 2 {
+		t.Errorf("server received %d commands, want 2", n)
+	}
+}
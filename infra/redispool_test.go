@@ -0,0 +1,57 @@
+package infra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+func TestRedisPoolCollector(t *testing.T) {
+	block := make(chan struct{})
+	server := newFakeRedis(t, func(args []string) string {
+		if args[0] == "blpop" {
+			<-block
+			return "*-1\r\n"
+		}
+		return "+PONG\r\n"
+	})
+	client := redis.NewClient(&redis.Options{Addr: server.Addr(), PoolSize: 1, PoolTimeout: 50 * time.Millisecond})
+	defer client.Close()
+	c := newRedisPoolCollector(client, "pool")
+
+	client.Ping()
+	client.Ping()
+	labels := map[string]string{"instance": "pool"}
+	for name, want := range map[string]float64{
+		"redis_pool_hits_total":   1,
+		"redis_pool_misses_total": 1,
+		"redis_pool_total_conns":  1,
+		"redis_pool_idle_conns":   1,
+		"redis_pool_in_use_conns": 0,
+		"redis_pool_size":         1,
+	} {
+		if v, ok := gatherValue(t, c, name, labels); !ok || v != want {
+			t.Errorf("%s = %v (found %v), want %v", name, v, ok, want)
+		}
+	}
+
+	// 唯一的连接被占用时，其他命令等连接超时
+	done := make(chan struct{})
+	go func() {
+		client.BLPop(0, "queue")
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if v, _ := gatherValue(t, c, "redis_pool_in_use_conns", labels); v != 1 {
+		t.Errorf("redis_pool_in_use_conns = %v, want 1", v)
+	}
+	if err := client.Ping().Err(); err == nil || classifyRedisError(err) != RedisErrPoolExhausted {
+		t.Errorf("Ping with exhausted pool = %v", err)
+	}
+	if v, _ := gatherValue(t, c, "redis_pool_timeouts_total", labels); v != 1 {
+		t.Errorf("redis_pool_timeouts_total = %v, want 1", v)
+	}
+	close(block)
+	<-done
+}
@@ -0,0 +1,108 @@
+package infra
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	MetricsReg.MustRegister(redisScriptCounter)
+}
+
+const unknownScript = "unknown"
+
+var (
+	redisScriptCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_script_calls_total",
+	}, []string{"instance", "script", "cmd", "result"})
+)
+
+// RegisterScript 注册lua脚本，EVAL/EVALSHA会按脚本名统计，返回脚本的sha1
+func (r *redisMonitor) RegisterScript(name string, src string) string {
+	sha := scriptSha(src)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scripts[sha] = name
+	r.scriptBodies[src] = name
+	return sha
+}
+
+func scriptSha(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
+
+func isScriptCmd(cmd redis.Cmder) bool {
+	name := cmd.Name()
+	return (name == "eval" || name == "evalsha") && len(cmd.Args()) >= 3
+}
+
+// scriptName 返回EVAL/EVALSHA对应的脚本名，未注册的脚本统一为unknown。
+// EVAL直接按脚本内容查找已注册的脚本，不用每次计算sha1
+func (r *redisMonitor) scriptName(cmd redis.Cmder) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var (
+		name string
+		ok   bool
+	)
+	if cmd.Name() == "eval" {
+		name, ok = r.scriptBodies[fmt.Sprint(cmd.Args()[1])]
+	} else {
+		name, ok = r.scripts[strings.ToLower(fmt.Sprint(cmd.Args()[1]))]
+	}
+	if !ok {
+		return unknownScript
+	}
+	return name
+}
+
+// scriptKeys 返回脚本的KEYS参数: EVAL script numkeys key [key ...] arg [arg ...]
+func scriptKeys(cmd redis.Cmder) []string {
+	args := cmd.Args()
+	numKeys, err := strconv.Atoi(fmt.Sprint(args[2]))
+	if err != nil || numKeys <= 0 {
+		return nil
+	}
+	keys := make([]string, 0, numKeys)
+	for i := 3; i < len(args) && i < 3+numKeys; i++ {
+		keys = append(keys, fmt.Sprint(args[i]))
+	}
+	return keys
+}
+
+// redisMetricName 返回指标里的name，脚本按脚本名和KEYS的前缀统计，不匹配脚本内容
+func (r *redisMonitor) redisMetricName(cmd redis.Cmder) (string, bool) {
+	if !isScriptCmd(cmd) {
+		return matchKey(truncateKey(100, cmdArgsString(cmd)))
+	}
+	name := cmd.Name() + " " + r.scriptName(cmd)
+	for _, key := range scriptKeys(cmd) {
+		if pattern, ok := matchPattern(key); ok {
+			return name + " " + pattern, true
+		}
+	}
+	return name, true
+}
+
+func (r *redisMonitor) recordScriptCall(cmd redis.Cmder, app string) {
+	result := "ok"
+	if err := cmd.Err(); err != nil && err != redis.Nil {
+		result = "error"
+		if classifyRedisError(err) == RedisErrNoScript {
+			// go-redis 的 Script.Run 收到NOSCRIPT后会改用EVAL重试
+			result = "noscript"
+		}
+	}
+	redisScriptCounter.With(prometheus.Labels{
+		"instance": app,
+		"script":   r.scriptName(cmd),
+		"cmd":      cmd.Name(),
+		"result":   result,
+	}).Inc()
+}
@@ -0,0 +1,75 @@
+package infra
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestRedisScript(t *testing.T) {
+	server := newFakeRedis(t, func(args []string) string {
+		if strings.ToLower(args[0]) == "evalsha" {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+		return respInt(1)
+	})
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	RedisMonitor.AddRedisHook(client, "script")
+
+	src := `return redis.call("INCR", KEYS[1])`
+	script := redis.NewScript(src)
+	if sha := RedisMonitor.RegisterScript("incr", src); sha != script.Hash() {
+		t.Fatalf("RegisterScript sha = %s, want %s", sha, script.Hash())
+	}
+	if n, err := script.Run(client, []string{"counter:1"}, 1).Int64(); err != nil || n != 1 {
+		t.Fatalf("script.Run = %d, %v", n, err)
+	}
+
+	labels := map[string]string{"instance": "script", "script": "incr"}
+	labels["cmd"], labels["result"] = "evalsha", "noscript"
+	if v, _ := gatherValue(t, redisScriptCounter, "redis_script_calls_total", labels); v != 1 {
+		t.Errorf("evalsha noscript = %v, want 1", v)
+	}
+	labels["cmd"], labels["result"] = "eval", "ok"
+	if v, _ := gatherValue(t, redisScriptCounter, "redis_script_calls_total", labels); v != 1 {
+		t.Errorf("eval ok = %v, want 1", v)
+	}
+	if name, _ := RedisMonitor.redisMetricName(redis.NewCmd("evalsha", script.Hash(), 1, "counter:1", 1)); name != "evalsha incr" {
+		t.Errorf("redisMetricName = %q", name)
+	}
+}
+
+func TestRedisScriptKeysInSlowLog(t *testing.T) {
+	server := newFakeRedis(t, func(args []string) string { return respInt(1) })
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	RedisMonitor.AddRedisHook(client, "scriptkey")
+	RedisMonitor.SetKeySlowThreshold("scriptslow:", -1)
+
+	var buf bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+
+	src := `return redis.call("SET", "scriptslow:" .. ARGV[1], 1)`
+	RedisMonitor.RegisterScript("setslow", src)
+	// 脚本内容包含慢命令前缀，但KEYS不匹配
+	client.Eval(src, []string{"fast:1"}, "x")
+	if strings.Contains(buf.String(), "redisslowlog") {
+		t.Fatalf("script body matched the slow key prefix: %s", buf.String())
+	}
+	client.Eval(src, []string{"scriptslow:1"}, "x")
+	if !strings.Contains(buf.String(), "redisslowlog") || !strings.Contains(buf.String(), `"key":"scriptslow:1"`) {
+		t.Errorf("slow log key is not KEYS[0]: %s", buf.String())
+	}
+	if name := RedisMonitor.scriptName(redis.NewCmd("eval", src, 0)); name != "setslow" {
+		t.Errorf("scriptName(eval) = %q, want setslow", name)
+	}
+	if name := RedisMonitor.scriptName(redis.NewCmd("eval", "return 1", 0)); name != unknownScript {
+		t.Errorf("scriptName(unregistered eval) = %q", name)
+	}
+}
@@ -0,0 +1,350 @@
+package infra
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisSlowlogFetchSize          = 128
+	defaultRedisServerPollInterval = 15 * time.Second
+)
+
+var (
+	redisServerSlowlogCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_server_slowlog_total",
+	}, []string{"instance"})
+)
+
+// INFO 中需要导出的字段
+var redisInfoMetrics = []struct {
+	field     string
+	name      string
+	valueType prometheus.ValueType
+}{
+	{"used_memory", "redis_server_used_memory_bytes", prometheus.GaugeValue},
+	{"used_memory_rss", "redis_server_used_memory_rss_bytes", prometheus.GaugeValue},
+	{"maxmemory", "redis_server_maxmemory_bytes", prometheus.GaugeValue},
+	{"mem_fragmentation_ratio", "redis_server_mem_fragmentation_ratio", prometheus.GaugeValue},
+	{"connected_clients", "redis_server_connected_clients", prometheus.GaugeValue},
+	{"blocked_clients", "redis_server_blocked_clients", prometheus.GaugeValue},
+	{"instantaneous_ops_per_sec", "redis_server_instantaneous_ops_per_sec", prometheus.GaugeValue},
+	{"total_commands_processed", "redis_server_commands_processed_total", prometheus.CounterValue},
+	{"evicted_keys", "redis_server_evicted_keys_total", prometheus.CounterValue},
+	{"expired_keys", "redis_server_expired_keys_total", prometheus.CounterValue},
+	{"keyspace_hits", "redis_server_keyspace_hits_total", prometheus.CounterValue},
+	{"keyspace_misses", "redis_server_keyspace_misses_total", prometheus.CounterValue},
+}
+
+type redisServerStats struct {
+	info      map[string]float64
+	keys      map[string]float64
+	expires   map[string]float64
+	latency   map[string][2]float64
+	slowlogID int64
+	polled    bool
+}
+
+// redisServerCollector 定时读取redis服务端的INFO、SLOWLOG和LATENCY，抓取时导出最近一次的结果
+type redisServerCollector struct {
+	mu      sync.Mutex
+	stats   map[string]*redisServerStats
+	clients map[string]*redis.Client
+	// stop 停止采集，多次调用只生效一次
+	stop func()
+
+	infoDescs      []*prometheus.Desc
+	keysDesc       *prometheus.Desc
+	expiresDesc    *prometheus.Desc
+	latencyDesc    *prometheus.Desc
+	latencyMaxDesc *prometheus.Desc
+}
+
+func newRedisServerCollector() *redisServerCollector {
+	c := &redisServerCollector{
+		stats:          make(map[string]*redisServerStats),
+		clients:        make(map[string]*redis.Client),
+		keysDesc:       prometheus.NewDesc("redis_server_keys", "Number of keys per db.", []string{"instance", "db"}, nil),
+		expiresDesc:    prometheus.NewDesc("redis_server_expiring_keys", "Number of keys with an expiry per db.", []string{"instance", "db"}, nil),
+		latencyDesc:    prometheus.NewDesc("redis_server_latency_latest_seconds", "Latest latency spike per event reported by LATENCY LATEST.", []string{"instance", "event"}, nil),
+		latencyMaxDesc: prometheus.NewDesc("redis_server_latency_max_seconds", "Max latency spike per event reported by LATENCY LATEST.", []string{"instance", "event"}, nil),
+	}
+	for _, m := range redisInfoMetrics {
+		c.infoDescs = append(c.infoDescs, prometheus.NewDesc(m.name, "INFO field "+m.field+".", []string{"instance"}, nil))
+	}
+	return c
+}
+
+func (c *redisServerCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.infoDescs {
+		ch <- d
+	}
+	ch <- c.keysDesc
+	ch <- c.expiresDesc
+	ch <- c.latencyDesc
+	ch <- c.latencyMaxDesc
+}
+
+func (c *redisServerCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for instance, stats := range c.stats {
+		for i, m := range redisInfoMetrics {
+			if v, ok := stats.info[m.field]; ok {
+				ch <- prometheus.MustNewConstMetric(c.infoDescs[i], m.valueType, v, instance)
+			}
+		}
+		for db, v := range stats.keys {
+			ch <- prometheus.MustNewConstMetric(c.keysDesc, prometheus.GaugeValue, v, instance, db)
+		}
+		for db, v := range stats.expires {
+			ch <- prometheus.MustNewConstMetric(c.expiresDesc, prometheus.GaugeValue, v, instance, db)
+		}
+		for event, v := range stats.latency {
+			ch <- prometheus.MustNewConstMetric(c.latencyDesc, prometheus.GaugeValue, v[0], instance, event)
+			ch <- prometheus.MustNewConstMetric(c.latencyMaxDesc, prometheus.GaugeValue, v[1], instance, event)
+		}
+	}
+}
+
+// StartServerCollector 定时采集通过AddRedisHook注册的redis实例的服务端指标，用来替代单独部署的redis_exporter。
+// interval小于等于0时为15s。已经在采集时再次调用不会启动新的采集，返回同一个stop，
+// stop停止采集并注销指标，之后可以重新调用StartServerCollector
+func (r *redisMonitor) StartServerCollector(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = defaultRedisServerPollInterval
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.serverCollector != nil {
+		return r.serverCollector.stop
+	}
+	c := newRedisServerCollector()
+	MetricsReg.MustRegister(c, redisServerSlowlogCounter)
+	done := make(chan struct{})
+	var once sync.Once
+	c.stop = func() {
+		once.Do(func() {
+			close(done)
+			r.mu.Lock()
+			if r.serverCollector == c {
+				r.serverCollector = nil
+			}
+			r.mu.Unlock()
+			MetricsReg.Unregister(c)
+			MetricsReg.Unregister(redisServerSlowlogCounter)
+		})
+	}
+	r.serverCollector = c
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		defer c.closeClients()
+		for {
+			r.mu.RLock()
+			clients := make(map[string]*redis.Client, len(r.clients))
+			for name, client := range r.clients {
+				clients[name] = client
+			}
+			r.mu.RUnlock()
+			for name, client := range clients {
+				c.poll(name, c.pollClient(name, client))
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return c.stop
+}
+
+// closeClients 关闭采集用的连接
+func (c *redisServerCollector) closeClients() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, pc := range c.clients {
+		pc.Close()
+		delete(c.clients, name)
+	}
+}
+
+// pollClient 使用不带hook的独立连接采集，避免采集命令影响应用自身的指标
+func (c *redisServerCollector) pollClient(name string, client *redis.Client) *redis.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pc, ok := c.clients[name]; ok {
+		return pc
+	}
+	opt := *client.Options()
+	opt.PoolSize = 1
+	opt.MinIdleConns = 0
+	pc := redis.NewClient(&opt)
+	c.clients[name] = pc
+	return pc
+}
+
+func (c *redisServerCollector) poll(name string, client *redis.Client) {
+	c.mu.Lock()
+	stats, ok := c.stats[name]
+	if !ok {
+		stats = &redisServerStats{slowlogID: -1}
+		c.stats[name] = stats
+	}
+	c.mu.Unlock()
+
+	info, err := client.Info().Result()
+	if err != nil {
+		log.WithError(err).WithField("app", name).Warn("redis server info fail")
+	}
+	infoStats, keys, expires := parseRedisInfo(info)
+
+	latency := make(map[string][2]float64)
+	latest, err := client.Do("latency", "latest").Result()
+	if err != nil {
+		log.WithError(err).WithField("app", name).Warn("redis server latency fail")
+	}
+	events, _ := latest.([]interface{})
+	for _, e := range events {
+		fields, _ := e.([]interface{})
+		if len(fields) < 4 {
+			continue
+		}
+		event := fmt.Sprint(fields[0])
+		latency[event] = [2]float64{toFloat(fields[2]) / 1000, toFloat(fields[3]) / 1000}
+	}
+
+	slowlog, slowlogErr := client.Do("slowlog", "get", redisSlowlogFetchSize).Result()
+	if slowlogErr != nil {
+		log.WithError(slowlogErr).WithField("app", name).Warn("redis server slowlog fail")
+	}
+	entries, _ := slowlog.([]interface{})
+
+	c.mu.Lock()
+	if info != "" {
+		stats.info, stats.keys, stats.expires = infoStats, keys, expires
+	}
+	stats.latency = latency
+	if slowlogErr != nil {
+		c.mu.Unlock()
+		return
+	}
+	lastID := stats.slowlogID
+	maxID := int64(-1)
+	for _, e := range entries {
+		if id, ok := slowlogID(e); ok && id > maxID {
+			maxID = id
+		}
+	}
+	if maxID < lastID {
+		// 服务端重启或者执行了SLOWLOG RESET，id重新计数
+		lastID = -1
+	}
+	stats.slowlogID = maxID
+	first := !stats.polled
+	stats.polled = true
+	c.mu.Unlock()
+
+	if first {
+		// 第一次采集只记录位置，不把历史慢日志当成新的
+		return
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		logServerSlowlog(name, entries[i], lastID)
+	}
+}
+
+func slowlogID(entry interface{}) (int64, bool) {
+	fields, _ := entry.([]interface{})
+	if len(fields) < 4 {
+		return 0, false
+	}
+	id, ok := fields[0].(int64)
+	return id, ok
+}
+
+func logServerSlowlog(name string, entry interface{}, lastID int64) {
+	id, ok := slowlogID(entry)
+	if !ok || id <= lastID {
+		return
+	}
+	fields := entry.([]interface{})
+	args := make([]string, 0)
+	if cmdArgs, ok := fields[3].([]interface{}); ok {
+		for _, a := range cmdArgs {
+			args = append(args, fmt.Sprint(a))
+		}
+	}
+	data := log.Fields{
+		Cost:       int64(toFloat(fields[2]) / 1000),
+		MetricType: "redisServerSlowlog",
+		"app":      name,
+		"id":       id,
+		"time":     time.Unix(int64(toFloat(fields[1])), 0).Format(time.RFC3339),
+		"args":     truncateKey(1024, strings.Join(args, " ")),
+	}
+	if len(fields) >= 6 {
+		data["client"] = fmt.Sprint(fields[4])
+		data["clientName"] = fmt.Sprint(fields[5])
+	}
+	redisServerSlowlogCounter.WithLabelValues(name).Inc()
+	log.WithFields(data).Warn("redisServerSlowlog")
+}
+
+func parseRedisInfo(info string) (map[string]float64, map[string]float64, map[string]float64) {
+	stats := make(map[string]float64)
+	keys := make(map[string]float64)
+	expires := make(map[string]float64)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if strings.HasPrefix(kv[0], "db") {
+			// db0:keys=1,expires=0,avg_ttl=0
+			for _, item := range strings.Split(kv[1], ",") {
+				pair := strings.SplitN(item, "=", 2)
+				if len(pair) != 2 {
+					continue
+				}
+				v, err := strconv.ParseFloat(pair[1], 64)
+				if err != nil {
+					continue
+				}
+				switch pair[0] {
+				case "keys":
+					keys[kv[0]] = v
+				case "expires":
+					expires[kv[0]] = v
+				}
+			}
+			continue
+		}
+		if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+			stats[kv[0]] = v
+		}
+	}
+	return stats, keys, expires
+}
+
+func toFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case int64:
+		return float64(v)
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	return 0
+}
@@ -0,0 +1,246 @@
+package infra
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeRedis 是一个只实现RESP协议的进程内redis替身，回复由handler决定
+type fakeRedis struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	handler func(args []string) string
+}
+
+func newFakeRedis(t *testing.T, handler func(args []string) string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, handler: handler}
+	go f.serve()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakeRedis) Addr() string {
+	return f.ln.Addr().String()
+}
+
+func (f *fakeRedis) setHandler(handler func(args []string) string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handler = handler
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			rd := bufio.NewReader(conn)
+			for {
+				args, err := readRESPCommand(rd)
+				if err != nil {
+					return
+				}
+				f.mu.Lock()
+				handler := f.handler
+				f.mu.Unlock()
+				if _, err := io.WriteString(conn, handler(args)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func readRESPCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func respBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func respArray(items ...string) string {
+	return fmt.Sprintf("*%d\r\n%s", len(items), strings.Join(items, ""))
+}
+
+func respInt(i int64) string {
+	return fmt.Sprintf(":%d\r\n", i)
+}
+
+func slowlogEntry(id int64, micros int64, args ...string) string {
+	cmd := make([]string, 0, len(args))
+	for _, a := range args {
+		cmd = append(cmd, respBulk(a))
+	}
+	return respArray(respInt(id), respInt(1690000000), respInt(micros), respArray(cmd...), respBulk("10.0.0.1:5000"), respBulk(""))
+}
+
+func gatherValue(t *testing.T, c prometheus.Collector, name string, labels map[string]string) (float64, bool) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	next:
+		for _, m := range family.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+					continue next
+				}
+			}
+			return metricValue(m), true
+		}
+	}
+	return 0, false
+}
+
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue()
+	case m.Counter != nil:
+		return m.GetCounter().GetValue()
+	case m.Histogram != nil:
+		return float64(m.GetHistogram().GetSampleCount())
+	}
+	return 0
+}
+
+func TestRedisServerCollector(t *testing.T) {
+	handler := func(slowlog string) func(args []string) string {
+		return func(args []string) string {
+			switch strings.ToLower(args[0]) {
+			case "info":
+				return respBulk("# Memory\r\nused_memory:1024\r\nmem_fragmentation_ratio:1.25\r\n# Clients\r\nconnected_clients:3\r\n" +
+					"# Stats\r\nevicted_keys:9\r\n# Keyspace\r\ndb0:keys=42,expires=40,avg_ttl=100\r\n")
+			case "latency":
+				return respArray(respArray(respBulk("command"), respInt(1690000000), respInt(25), respInt(120)))
+			case "slowlog":
+				return slowlog
+			}
+			return "-ERR unknown command\r\n"
+		}
+	}
+	server := newFakeRedis(t, handler(respArray(slowlogEntry(7, 15000, "keys", "*"))))
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	c := newRedisServerCollector()
+	c.poll("cache", client)
+
+	cases := []struct {
+		name   string
+		labels map[string]string
+		value  float64
+	}{
+		{"redis_server_used_memory_bytes", map[string]string{"instance": "cache"}, 1024},
+		{"redis_server_mem_fragmentation_ratio", map[string]string{"instance": "cache"}, 1.25},
+		{"redis_server_connected_clients", map[string]string{"instance": "cache"}, 3},
+		{"redis_server_evicted_keys_total", map[string]string{"instance": "cache"}, 9},
+		{"redis_server_keys", map[string]string{"instance": "cache", "db": "db0"}, 42},
+		{"redis_server_expiring_keys", map[string]string{"instance": "cache", "db": "db0"}, 40},
+		{"redis_server_latency_latest_seconds", map[string]string{"instance": "cache", "event": "command"}, 0.025},
+		{"redis_server_latency_max_seconds", map[string]string{"instance": "cache", "event": "command"}, 0.12},
+	}
+	for _, tc := range cases {
+		v, ok := gatherValue(t, c, tc.name, tc.labels)
+		if !ok || v != tc.value {
+			t.Errorf("%s%v = %v (found %v), want %v", tc.name, tc.labels, v, ok, tc.value)
+		}
+	}
+
+	// 第一次采集只记录位置
+	before, _ := gatherValue(t, redisServerSlowlogCounter, "redis_server_slowlog_total", map[string]string{"instance": "cache"})
+	if before != 0 {
+		t.Fatalf("first poll logged %v historical slowlog entries", before)
+	}
+	server.setHandler(handler(respArray(slowlogEntry(9, 30000, "smembers", "big"), slowlogEntry(8, 20000, "hgetall", "big"), slowlogEntry(7, 15000, "keys", "*"))))
+	c.poll("cache", client)
+	after, _ := gatherValue(t, redisServerSlowlogCounter, "redis_server_slowlog_total", map[string]string{"instance": "cache"})
+	if after != 2 {
+		t.Errorf("redis_server_slowlog_total = %v, want 2", after)
+	}
+}
+
+func TestStartServerCollectorStop(t *testing.T) {
+	var infos int32
+	server := newFakeRedis(t, func(args []string) string {
+		if strings.ToLower(args[0]) == "info" {
+			atomic.AddInt32(&infos, 1)
+			return respBulk("# Clients\r\nconnected_clients:1\r\n")
+		}
+		return respArray()
+	})
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	RedisMonitor.AddRedisHook(client, "serverstop")
+
+	stop := RedisMonitor.StartServerCollector(0)
+	c := RedisMonitor.serverCollector
+	// 重复调用不会启动新的采集
+	RedisMonitor.StartServerCollector(time.Millisecond)
+	if RedisMonitor.serverCollector != c {
+		t.Fatal("second StartServerCollector replaced the running collector")
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&infos) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&infos) != 1 {
+		t.Fatalf("INFO polled %d times, want 1", infos)
+	}
+	stop()
+	stop()
+	if RedisMonitor.serverCollector != nil {
+		t.Fatal("collector still set after stop")
+	}
+	RedisMonitor.StartServerCollector(time.Hour)()
+}
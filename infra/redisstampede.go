@@ -0,0 +1,194 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	MetricsReg.MustRegister(cacheStampedeCounter)
+}
+
+const maxStampedeWindows = 10000
+
+var (
+	cacheStampedeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_stampede_total",
+	}, []string{"instance", "pattern"})
+)
+
+// StampedeRule 同一个key(ByPattern为true时是同一个key前缀)在Window内未回填的miss数达到Threshold时认为发生了缓存击穿
+type StampedeRule struct {
+	KeyPrefix string
+	Threshold int
+	Window    time.Duration
+	ByPattern bool
+}
+
+type stampedeWindow struct {
+	start    time.Time
+	inflight int
+	id       string
+	states   []*requestState
+}
+
+type stampedeDetector struct {
+	mu      sync.Mutex
+	rules   []StampedeRule
+	windows map[string]*stampedeWindow
+}
+
+var redisStampedeDetector = &stampedeDetector{
+	windows: make(map[string]*stampedeWindow),
+}
+
+// DetectStampede 开启缓存击穿检测
+func (r *redisMonitor) DetectStampede(rule StampedeRule) {
+	redisStampedeDetector.mu.Lock()
+	defer redisStampedeDetector.mu.Unlock()
+	redisStampedeDetector.rules = append(redisStampedeDetector.rules, rule)
+}
+
+var cmdContexts sync.Map
+
+// WithContext 返回绑定了ctx的client，hook可以通过ctx把redis命令和所在的请求关联起来。
+// go-redis v6 的命令不带ctx，直接用AddRedisHook的client执行的命令，日志里没有trace_id、span_id和uid，
+// span也不会挂在请求的span下面，需要在请求里用 RedisMonitor.WithContext(r.Context(), client) 执行命令
+func (r *redisMonitor) WithContext(ctx context.Context, client *redis.Client) *redis.Client {
+	c := client.WithContext(ctx)
+	c.WrapProcess(func(oldProcess func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			cmdContexts.Store(cmd, ctx)
+			defer cmdContexts.Delete(cmd)
+			return oldProcess(cmd)
+		}
+	})
+	c.WrapProcessPipeline(func(oldProcess func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmders []redis.Cmder) error {
+			for _, cmd := range cmders {
+				cmdContexts.Store(cmd, ctx)
+			}
+			defer func() {
+				for _, cmd := range cmders {
+					cmdContexts.Delete(cmd)
+				}
+			}()
+			return oldProcess(cmders)
+		}
+	})
+	return c
+}
+
+func cmdContext(cmd redis.Cmder) context.Context {
+	if ctx, ok := cmdContexts.Load(cmd); ok {
+		return ctx.(context.Context)
+	}
+	return context.Background()
+}
+
+func (d *stampedeDetector) rule(key string) (StampedeRule, bool) {
+	for _, rule := range d.rules {
+		if strings.Contains(key, rule.KeyPrefix) {
+			return rule, true
+		}
+	}
+	return StampedeRule{}, false
+}
+
+func windowID(app string, key string, rule StampedeRule) string {
+	if rule.ByPattern {
+		return app + " " + rule.KeyPrefix
+	}
+	return app + " " + key
+}
+
+func (d *stampedeDetector) onMiss(ctx context.Context, app string, key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rule, ok := d.rule(key)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	id := windowID(app, key, rule)
+	w := d.windows[id]
+	if w == nil || now.Sub(w.start) > rule.Window {
+		if w == nil && len(d.windows) >= maxStampedeWindows {
+			d.cleanup(now)
+			if len(d.windows) >= maxStampedeWindows {
+				return
+			}
+		}
+		w = &stampedeWindow{start: now}
+		d.windows[id] = w
+	}
+	w.inflight++
+	state := requestStateFrom(ctx)
+	if w.id != "" {
+		// 已经上报过，后续的miss直接关联
+		if state != nil {
+			state.markStampede(w.id, key)
+		}
+		return
+	}
+	if state != nil && len(w.states) < rule.Threshold {
+		w.states = append(w.states, state)
+	}
+	if w.inflight < rule.Threshold {
+		return
+	}
+	w.id = fmt.Sprintf("%s-%d", key, w.start.UnixNano())
+	for _, s := range w.states {
+		s.markStampede(w.id, key)
+	}
+	w.states = nil
+	cacheStampedeCounter.With(prometheus.Labels{
+		"instance": app,
+		"pattern":  rule.KeyPrefix,
+	}).Inc()
+	log.WithFields(withRequestFields(ctx, log.Fields{
+		MetricType:   "cacheStampede",
+		"app":        app,
+		"key":        truncateKey(100, key),
+		"pattern":    rule.KeyPrefix,
+		"misses":     w.inflight,
+		"window":     rule.Window.String(),
+		"stampedeId": w.id,
+	})).Error("cacheStampede")
+}
+
+// onWrite 回填缓存后减少未回填的miss数
+func (d *stampedeDetector) onWrite(cmd redis.Cmder, app string) {
+	if cmd.Err() != nil || (!ttlWriteCmds[cmd.Name()] && cmd.Name() != "setex" && cmd.Name() != "psetex") {
+		return
+	}
+	args := cmd.Args()
+	if len(args) < 2 {
+		return
+	}
+	key := fmt.Sprint(args[1])
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rule, ok := d.rule(key)
+	if !ok {
+		return
+	}
+	if w := d.windows[windowID(app, key, rule)]; w != nil && w.inflight > 0 {
+		w.inflight--
+	}
+}
+
+func (d *stampedeDetector) cleanup(now time.Time) {
+	for id, w := range d.windows {
+		rule, _ := d.rule(id)
+		if now.Sub(w.start) > rule.Window {
+			delete(d.windows, id)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCacheStampede(t *testing.T) {
+	server := newFakeRedis(t, func(args []string) string {
+		if strings.ToLower(args[0]) == "get" {
+			return "$-1\r\n"
+		}
+		return "+OK\r\n"
+	})
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	RedisMonitor.AddRedisHook(client, "stampede")
+	RedisMonitor.DetectStampede(StampedeRule{KeyPrefix: "hot:", Threshold: 3, Window: time.Minute})
+
+	var buf bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+
+	states := make([]*requestState, 0, 3)
+	var last TraceContext
+	for i := 0; i < 3; i++ {
+		last = TraceContext{TraceID: newTraceID(), SpanID: newSpanID()}
+		ctx := withRequestState(ContextWithTrace(context.Background(), last))
+		states = append(states, requestStateFrom(ctx))
+		if err := RedisMonitor.WithContext(ctx, client).Get("hot:1").Err(); err != redis.Nil {
+			t.Fatalf("Get error = %v", err)
+		}
+		if i == 0 {
+			// 回填过的miss不再计入
+			client.Set("hot:1", "v", time.Minute)
+			client.Get("hot:1")
+		}
+	}
+	if v, _ := gatherValue(t, cacheStampedeCounter, "cache_stampede_total", map[string]string{"instance": "stampede", "pattern": "hot:"}); v != 1 {
+		t.Fatalf("cache_stampede_total = %v, want 1", v)
+	}
+	if !strings.Contains(buf.String(), "cacheStampede") || !strings.Contains(buf.String(), `"trace_id":"`+last.TraceID+`"`) {
+		t.Errorf("cacheStampede log missing trace_id: %s", buf.String())
+	}
+	for i, state := range states {
+		if id, key := state.stampede(); id == "" || key != "hot:1" {
+			t.Errorf("request %d not correlated with stampede: id=%q key=%q", i, id, key)
+		}
+	}
+}
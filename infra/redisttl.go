@@ -0,0 +1,310 @@
+package infra
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	MetricsReg.MustRegister(redisTTLViolationCounter)
+}
+
+const (
+	defaultTTLAuditWindow = time.Second
+	minTTLAuditSweep      = 10 * time.Millisecond
+	maxTTLAuditPending    = 10000
+
+	ttlReasonNoTTL   = "no_ttl"
+	ttlReasonPersist = "persist"
+	ttlReasonTooLong = "ttl_too_long"
+)
+
+var (
+	redisTTLViolationCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_ttl_violations_total",
+	}, []string{"instance", "pattern", "reason"})
+)
+
+// 写入后需要设置过期时间的命令
+var ttlWriteCmds = map[string]bool{
+	"set":    true,
+	"setnx":  true,
+	"mset":   true,
+	"msetnx": true,
+	"hset":   true,
+	"hmset":  true,
+	"hsetnx": true,
+	"sadd":   true,
+	"zadd":   true,
+	"lpush":  true,
+	"rpush":  true,
+}
+
+// 写已经存在的key时不会改变过期时间的命令，上报前要用TTL确认key确实没有过期时间
+var ttlKeepCmds = map[string]bool{
+	"hset":   true,
+	"hmset":  true,
+	"hsetnx": true,
+	"sadd":   true,
+	"zadd":   true,
+	"lpush":  true,
+	"rpush":  true,
+}
+
+var ttlExpireCmds = map[string]bool{
+	"expire":    true,
+	"pexpire":   true,
+	"expireat":  true,
+	"pexpireat": true,
+}
+
+type pendingTTLWrite struct {
+	app      string
+	key      string
+	pattern  string
+	cmd      string
+	deadline time.Time
+	// 写入不会改变已有key的过期时间，需要用TTL确认
+	confirm bool
+}
+
+// ttlAuditor 检查写入的key有没有设置过期时间，写入后window内没有EXPIRE的key会在后台被上报
+type ttlAuditor struct {
+	mu      sync.Mutex
+	window  time.Duration
+	maxTTLs prefixDurations
+	pending map[string]*pendingTTLWrite
+	// keyTTL 查询key的过期时间，返回-1s表示没有过期时间
+	keyTTL    func(app string, key string) (time.Duration, error)
+	sweepOnce sync.Once
+}
+
+var redisTTLAuditor = &ttlAuditor{
+	window:  defaultTTLAuditWindow,
+	pending: make(map[string]*pendingTTLWrite),
+	keyTTL:  redisKeyTTL,
+}
+
+// AuditTTL 对以keyPrefix开头的key开启过期时间审计，多个前缀都匹配时最长的前缀生效，
+// maxTTL大于0时过期时间超过maxTTL也会上报
+func (r *redisMonitor) AuditTTL(keyPrefix string, maxTTL time.Duration) {
+	redisTTLAuditor.mu.Lock()
+	redisTTLAuditor.maxTTLs = redisTTLAuditor.maxTTLs.set(keyPrefix, maxTTL)
+	redisTTLAuditor.mu.Unlock()
+	redisTTLAuditor.sweepOnce.Do(func() {
+		go redisTTLAuditor.run()
+	})
+}
+
+// SetTTLAuditWindow 设置写命令之后等待EXPIRE的时间，默认1s
+func (r *redisMonitor) SetTTLAuditWindow(window time.Duration) {
+	redisTTLAuditor.mu.Lock()
+	defer redisTTLAuditor.mu.Unlock()
+	redisTTLAuditor.window = window
+}
+
+func (a *ttlAuditor) auditPattern(key string) (string, time.Duration, bool) {
+	pd, ok := a.maxTTLs.match(key)
+	return pd.prefix, pd.duration, ok
+}
+
+// run 定时上报超过window没有EXPIRE的写入，redis没有流量时也能上报
+func (a *ttlAuditor) run() {
+	for {
+		a.mu.Lock()
+		interval := a.window / 2
+		a.mu.Unlock()
+		if interval < minTTLAuditSweep {
+			interval = minTTLAuditSweep
+		}
+		time.Sleep(interval)
+		a.report(a.sweep(time.Now()))
+	}
+}
+
+func (a *ttlAuditor) audit(cmds []redis.Cmder, app string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.maxTTLs) == 0 {
+		return
+	}
+	now := time.Now()
+	for i, cmd := range cmds {
+		if cmd.Err() != nil {
+			continue
+		}
+		args := cmd.Args()
+		if len(args) < 2 {
+			continue
+		}
+		name := cmd.Name()
+		key := fmt.Sprint(args[1])
+		switch {
+		case name == "persist":
+			if pattern, _, ok := a.auditPattern(key); ok {
+				reportTTLViolation(app, pattern, key, name, ttlReasonPersist, 0)
+			}
+		case ttlExpireCmds[name]:
+			delete(a.pending, app+" "+key)
+			if len(args) >= 3 {
+				a.checkMaxTTL(app, key, name, expireTTL(name, args[2], now))
+			}
+		case name == "setex" || name == "psetex":
+			if len(args) >= 3 {
+				a.checkMaxTTL(app, key, name, expireTTL(name, args[2], now))
+			}
+		case name == "set" && len(args) > 3:
+			if ttl, ok := setTTL(args[3:], now); ok {
+				a.checkMaxTTL(app, key, name, ttl)
+				continue
+			}
+			a.addPending(cmds[i+1:], app, key, name, now)
+		case name == "mset" || name == "msetnx":
+			for j := 1; j < len(args); j += 2 {
+				a.addPending(cmds[i+1:], app, fmt.Sprint(args[j]), name, now)
+			}
+		case ttlWriteCmds[name]:
+			// setnx、msetnx没有写入
+			if b, ok := cmd.(*redis.BoolCmd); ok && !b.Val() {
+				continue
+			}
+			a.addPending(cmds[i+1:], app, key, name, now)
+		}
+	}
+}
+
+func (a *ttlAuditor) addPending(following []redis.Cmder, app string, key string, name string, now time.Time) {
+	pattern, _, ok := a.auditPattern(key)
+	if !ok {
+		return
+	}
+	// 同一个pipeline里后面紧跟了EXPIRE
+	for _, cmd := range following {
+		args := cmd.Args()
+		if ttlExpireCmds[cmd.Name()] && len(args) >= 2 && fmt.Sprint(args[1]) == key {
+			return
+		}
+	}
+	id := app + " " + key
+	if _, exists := a.pending[id]; !exists && len(a.pending) >= maxTTLAuditPending {
+		return
+	}
+	a.pending[id] = &pendingTTLWrite{app: app, key: key, pattern: pattern, cmd: name, deadline: now.Add(a.window), confirm: ttlKeepCmds[name]}
+}
+
+// sweep 取出超过window的写入
+func (a *ttlAuditor) sweep(now time.Time) []*pendingTTLWrite {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var expired []*pendingTTLWrite
+	for id, w := range a.pending {
+		if now.Before(w.deadline) {
+			continue
+		}
+		delete(a.pending, id)
+		expired = append(expired, w)
+	}
+	return expired
+}
+
+// report 上报没有过期时间的写入，要查询redis，不能持有锁
+func (a *ttlAuditor) report(writes []*pendingTTLWrite) {
+	for _, w := range writes {
+		if w.confirm {
+			// key之前已经有过期时间，或者已经被删除
+			if ttl, err := a.keyTTL(w.app, w.key); err != nil || ttl != -time.Second {
+				continue
+			}
+		}
+		reportTTLViolation(w.app, w.pattern, w.key, w.cmd, ttlReasonNoTTL, 0)
+	}
+}
+
+// redisKeyTTL 用AddRedisHook注册的client查询key的过期时间
+func redisKeyTTL(app string, key string) (time.Duration, error) {
+	RedisMonitor.mu.RLock()
+	client := RedisMonitor.clients[app]
+	RedisMonitor.mu.RUnlock()
+	if client == nil {
+		return 0, fmt.Errorf("redis: instance %s has no hook", app)
+	}
+	return client.TTL(key).Result()
+}
+
+func (a *ttlAuditor) checkMaxTTL(app string, key string, name string, ttl time.Duration) {
+	pattern, maxTTL, ok := a.auditPattern(key)
+	if !ok || maxTTL <= 0 || ttl <= maxTTL {
+		return
+	}
+	reportTTLViolation(app, pattern, key, name, ttlReasonTooLong, ttl)
+}
+
+func reportTTLViolation(app string, pattern string, key string, name string, reason string, ttl time.Duration) {
+	redisTTLViolationCounter.With(prometheus.Labels{
+		"instance": app,
+		"pattern":  pattern,
+		"reason":   reason,
+	}).Inc()
+	metricType := "redisNoTTL"
+	data := log.Fields{
+		"app":     app,
+		"key":     truncateKey(100, key),
+		"pattern": pattern,
+		"name":    name,
+		"reason":  reason,
+	}
+	if reason == ttlReasonTooLong {
+		metricType = "redisTTLTooLong"
+		data["ttl"] = ttl.String()
+	}
+	data[MetricType] = metricType
+	log.WithFields(data).Warn(metricType)
+}
+
+// setTTL 解析 SET key value [EX seconds|PX milliseconds|EXAT|PXAT|KEEPTTL]
+func setTTL(opts []interface{}, now time.Time) (time.Duration, bool) {
+	for i, opt := range opts {
+		o := strings.ToLower(fmt.Sprint(opt))
+		if o == "keepttl" {
+			return 0, true
+		}
+		if i+1 >= len(opts) {
+			continue
+		}
+		switch o {
+		case "ex":
+			return expireTTL("expire", opts[i+1], now), true
+		case "px":
+			return expireTTL("pexpire", opts[i+1], now), true
+		case "exat":
+			return expireTTL("expireat", opts[i+1], now), true
+		case "pxat":
+			return expireTTL("pexpireat", opts[i+1], now), true
+		}
+	}
+	return 0, false
+}
+
+func expireTTL(name string, arg interface{}, now time.Time) time.Duration {
+	v, err := strconv.ParseInt(fmt.Sprint(arg), 10, 64)
+	if err != nil {
+		return 0
+	}
+	switch name {
+	case "expire", "setex":
+		return time.Duration(v) * time.Second
+	case "pexpire", "psetex":
+		return time.Duration(v) * time.Millisecond
+	case "expireat":
+		return time.Unix(v, 0).Sub(now)
+	case "pexpireat":
+		return time.UnixMilli(v).Sub(now)
+	}
+	return 0
+}
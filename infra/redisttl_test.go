@@ -0,0 +1,101 @@
+package infra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+func TestTTLAudit(t *testing.T) {
+	ttls := map[string]time.Duration{
+		"session:3":     -time.Second,
+		"session:hot":   time.Minute,
+		"session:gone":  -2 * time.Second,
+		"session:nottl": -time.Second,
+	}
+	a := &ttlAuditor{
+		window:  time.Millisecond,
+		maxTTLs: prefixDurations{}.set("session:", time.Hour).set("session:admin:", 10*time.Minute),
+		pending: make(map[string]*pendingTTLWrite),
+		keyTTL: func(app string, key string) (time.Duration, error) {
+			return ttls[key], nil
+		},
+	}
+	violations := func(pattern string, reason string) float64 {
+		v, _ := gatherValue(t, redisTTLViolationCounter, "redis_ttl_violations_total", map[string]string{"instance": "ttl", "pattern": pattern, "reason": reason})
+		return v
+	}
+	flush := func() {
+		time.Sleep(2 * time.Millisecond)
+		a.report(a.sweep(time.Now()))
+	}
+
+	a.audit([]redis.Cmder{
+		redis.NewStatusCmd("set", "session:1", "v"),
+		redis.NewBoolCmd("expire", "session:1", 60),
+		redis.NewStatusCmd("set", "session:2", "v", "ex", 120),
+		redis.NewStatusCmd("set", "other:1", "v"),
+		redis.NewStatusCmd("set", "x:session:1", "v"),
+	}, "ttl")
+	flush()
+	if len(a.pending) != 0 || violations("session:", ttlReasonNoTTL) != 0 {
+		t.Fatalf("writes with expiry reported: pending=%d", len(a.pending))
+	}
+
+	// 写已有过期时间或者已经删除的key不上报
+	a.audit([]redis.Cmder{
+		redis.NewIntCmd("hset", "session:3", "f", "v"),
+		redis.NewIntCmd("hset", "session:hot", "f", "v"),
+		redis.NewIntCmd("sadd", "session:gone", "m"),
+		redis.NewStatusCmd("set", "session:hot", "v"),
+	}, "ttl")
+	flush()
+	if v := violations("session:", ttlReasonNoTTL); v != 2 {
+		t.Errorf("no_ttl violations = %v, want 2", v)
+	}
+
+	// setnx没有写入时不上报
+	setnx := redis.NewBoolCmd("setnx", "session:nottl", "v")
+	a.audit([]redis.Cmder{setnx}, "ttl")
+	flush()
+	if v := violations("session:", ttlReasonNoTTL); v != 2 {
+		t.Errorf("no_ttl violations after failed setnx = %v, want 2", v)
+	}
+
+	a.audit([]redis.Cmder{
+		redis.NewStatusCmd("setex", "session:5", 7200, "v"),
+		redis.NewStatusCmd("setex", "session:admin:1", 1800, "v"),
+		redis.NewStatusCmd("setex", "session:6", 1800, "v"),
+		redis.NewBoolCmd("persist", "session:4"),
+	}, "ttl")
+	if v := violations("session:", ttlReasonTooLong); v != 1 {
+		t.Errorf("session: ttl_too_long violations = %v, want 1", v)
+	}
+	// 重叠的前缀按最长的前缀匹配
+	if v := violations("session:admin:", ttlReasonTooLong); v != 1 {
+		t.Errorf("session:admin: ttl_too_long violations = %v, want 1", v)
+	}
+	if v := violations("session:", ttlReasonPersist); v != 1 {
+		t.Errorf("persist violations = %v, want 1", v)
+	}
+}
+
+func TestTTLAuditReportsWithoutTraffic(t *testing.T) {
+	a := &ttlAuditor{
+		window:  time.Millisecond,
+		maxTTLs: prefixDurations{}.set("idle:", 0),
+		pending: make(map[string]*pendingTTLWrite),
+		keyTTL:  redisKeyTTL,
+	}
+	a.audit([]redis.Cmder{redis.NewStatusCmd("set", "idle:1", "v")}, "ttlidle")
+	go a.run()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if v, _ := gatherValue(t, redisTTLViolationCounter, "redis_ttl_violations_total", map[string]string{"instance": "ttlidle", "reason": ttlReasonNoTTL}); v == 1 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("pending write was not reported without later commands")
+}
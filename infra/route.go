@@ -0,0 +1,145 @@
+package infra
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 未匹配到路由的请求统一使用的api标签
+const OtherAPI = "other"
+
+// 解析不到路由模板时最多记录的归一化path个数
+const defaultMaxNormalizedPaths = 100
+
+var (
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+type httpMonitor struct {
+	mu             sync.RWMutex
+	routeResolver  func(r *http.Request) string
+	pathNormalizer func(path string) string
+	// 归一化之后的path，数量有上限
+	normalizedPaths    *pathLabels
+	maxNormalizedPaths int
+	capture            *requestCapture
+	mux                *http.ServeMux
+	limiter            *aimdLimiter
+
+	clientSlowThreshold time.Duration
+	handlerTimeout      time.Duration
+	accessLog           *accessLog
+	slos                []*sloTracker
+	uidExtractors       []UIDExtractor
+}
+
+var HttpMonitor = &httpMonitor{
+	pathNormalizer:     NormalizePath,
+	normalizedPaths:    newPathLabels(defaultMaxNormalizedPaths),
+	maxNormalizedPaths: defaultMaxNormalizedPaths,
+	capture:            newRequestCapture(defaultRequestCaptureConfig),
+}
+
+// SetRouteResolver 设置从请求中解析路由模板的方法，用于chi、gorilla等路由，比如
+//
+//	chi:     func(r *http.Request) string { return chi.RouteContext(r.Context()).RoutePattern() }
+//	gorilla: func(r *http.Request) string { t, _ := mux.CurrentRoute(r).GetPathTemplate(); return t }
+func (h *httpMonitor) SetRouteResolver(f func(r *http.Request) string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.routeResolver = f
+}
+
+// SetPathNormalizer 设置解析不到路由模板时对path的归一化方法，默认是NormalizePath
+func (h *httpMonitor) SetPathNormalizer(f func(path string) string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pathNormalizer = f
+}
+
+// SetMaxNormalizedPaths 设置解析不到路由模板时最多记录的归一化path个数，默认100，
+// 超过之后新的path统一为other，避免扫描器的随机path让基数爆炸。之后创建的InstrumentedTransport也使用这个上限
+func (h *httpMonitor) SetMaxNormalizedPaths(n int) {
+	if n <= 0 {
+		n = defaultMaxNormalizedPaths
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.maxNormalizedPaths = n
+	h.normalizedPaths = newPathLabels(n)
+}
+
+func (h *httpMonitor) getMaxNormalizedPaths() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.maxNormalizedPaths
+}
+
+// apiLabel 返回请求的api标签，优先使用路由模板，避免path中的id导致指标基数爆炸
+func (h *httpMonitor) apiLabel(r *http.Request, status int) string {
+	if pattern := routePattern(r); pattern != "" {
+		return pattern
+	}
+	h.mu.RLock()
+	resolver, normalizer, paths := h.routeResolver, h.pathNormalizer, h.normalizedPaths
+	h.mu.RUnlock()
+	if resolver != nil {
+		if pattern := resolver(r); pattern != "" {
+			return pattern
+		}
+	}
+	if status == http.StatusNotFound {
+		return OtherAPI
+	}
+	if normalizer == nil {
+		return paths.label(r.URL.Path)
+	}
+	return paths.label(normalizer(r.URL.Path))
+}
+
+// pathLabels 记录出现过的归一化path，超过max个之后新的path返回other
+type pathLabels struct {
+	mu   sync.Mutex
+	max  int
+	seen map[string]struct{}
+}
+
+func newPathLabels(max int) *pathLabels {
+	return &pathLabels{max: max, seen: make(map[string]struct{})}
+}
+
+func (p *pathLabels) label(path string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.seen[path]; ok {
+		return path
+	}
+	if len(p.seen) >= p.max {
+		return OtherAPI
+	}
+	p.seen[path] = struct{}{}
+	return path
+}
+
+// NormalizePath 把path中的数字和UUID段替换成:id
+func NormalizePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if numericSegment.MatchString(seg) || uuidSegment.MatchString(seg) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// stripPatternMethod 去掉ServeMux模板里的请求方法，比如 "GET /users/{id}" 返回 "/users/{id}"
+func stripPatternMethod(pattern string) string {
+	if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+		return strings.TrimLeft(pattern[i+1:], " \t")
+	}
+	return pattern
+}
@@ -0,0 +1,10 @@
+//go:build go1.23
+
+package infra
+
+import "net/http"
+
+// routePattern 返回ServeMux匹配到的路由模板，Request.Pattern 从go1.23开始提供
+func routePattern(r *http.Request) string {
+	return stripPatternMethod(r.Pattern)
+}
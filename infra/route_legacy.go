@@ -0,0 +1,9 @@
+//go:build !go1.23
+
+package infra
+
+import "net/http"
+
+func routePattern(r *http.Request) string {
+	return ""
+}
@@ -0,0 +1,42 @@
+//go:build go1.23
+
+//go:debug httpmuxgo121=0
+
+package infra
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteTemplateLabel(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /route/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := MetricMiddleware(mux)
+	for _, path := range []string{"/route/users/1", "/route/users/2", "/route/random/abc"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if v, _ := gatherValue(t, serverHandleCounter, "server_handle_total", map[string]string{"type": TypeHTTP, "api": "/route/users/{id}"}); v != 2 {
+		t.Errorf("route template count = %v, want 2", v)
+	}
+	if v, _ := gatherValue(t, serverHandleCounter, "server_handle_total", map[string]string{"type": TypeHTTP, "api": OtherAPI}); v != 1 {
+		t.Errorf("other count = %v, want 1", v)
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	cases := map[string]string{
+		"/users/42/orders": "/users/:id/orders",
+		"/files/3f2504e0-4f89-11d3-9a0c-0305e82c3301": "/files/:id",
+		"/v1/healthz": "/v1/healthz",
+	}
+	for path, want := range cases {
+		if got := NormalizePath(path); got != want {
+			t.Errorf("NormalizePath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+// StatusClientClosedRequest 客户端在handler执行完之前断开，和nginx的499一致
+const StatusClientClosedRequest = 499
+
+// server_aborted_requests_total的reason标签
+const (
+	abortClientClosed = "client_closed"
+	abortTimeout      = "timeout"
+)
+
+func init() {
+	MetricsReg.MustRegister(serverAbortedCounter)
+}
+
+var serverAbortedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "server_aborted_requests_total",
+	Help: "Requests whose context was cancelled before the handler returned, by reason client_closed (499) or timeout (504).",
+}, []string{"type", "api", "reason"})
+
+// SetHandlerTimeout 给handler的ctx设置超时，超时的请求记为504，0表示不设置。
+// 只有ctx上的deadline能被识别为超时：http.Server的ReadTimeout、WriteTimeout不会取消ctx，
+// http.TimeoutHandler只取消它里面的handler的ctx，MetricMiddleware在它外面时识别不到
+func (h *httpMonitor) SetHandlerTimeout(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handlerTimeout = d
+}
+
+func (h *httpMonitor) getHandlerTimeout() time.Duration {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.handlerTimeout
+}
+
+// abortReason handler执行期间ctx被取消时返回原因，客户端断开记为499，ctx的deadline到了记为504
+func abortReason(ctx context.Context) (string, int) {
+	switch err := ctx.Err(); {
+	case errors.Is(err, context.DeadlineExceeded):
+		return abortTimeout, http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return abortClientClosed, StatusClientClosedRequest
+	}
+	return "", 0
+}
+
+// ResponseState 由gin、echo这些框架的适配器实现，在handler执行之后提供框架记录的响应信息
+type ResponseState interface {
+	// 框架匹配到的路由模板，没有匹配时返回空，由HttpMonitor按path解析
+	Route() string
+	Status() int
+	Written() int64
+	// 是否已经写了响应头
+	Committed() bool
+}
+
+// ServeInstrumented 是MetricMiddleware的完整流程，供框架适配器使用，和MetricMiddleware加RecoveryMiddleware的效果一样。
+// w 用于写限流的503和panic的500，next 执行框架的handler链，需要把传入的请求设置回框架的context
+func ServeInstrumented(w http.ResponseWriter, r *http.Request, state ResponseState, next func(r *http.Request)) {
+	serveInstrumented(w, r, state, next, true)
+}
+
+func serveInstrumented(w http.ResponseWriter, r *http.Request, state ResponseState, next func(r *http.Request), recoverPanic bool) {
+	now := time.Now()
+	ctx := r.Context()
+	if _, ok := TraceFromContext(ctx); !ok {
+		ctx = ContextWithTrace(ctx, traceFromRequest(r))
+	}
+	ctx, span := TraceMonitor.startServerSpan(ctx, r.Method, semconv.HTTPMethod(r.Method), semconv.URLPath(r.URL.Path))
+	r = r.WithContext(withRequestState(ctx))
+	SetRequestUID(r.Context(), HttpMonitor.extractUID(r))
+	preAPI := HttpMonitor.preRouteLabel(r)
+	inflight := httpInflightGauge.WithLabelValues(preAPI)
+	inflight.Inc()
+	defer inflight.Dec()
+
+	limiter := HttpMonitor.loadShedder()
+	if limiter != nil && !limiter.acquire() {
+		httpShedCounter.WithLabelValues(preAPI).Inc()
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		cost := time.Since(now)
+		MetricMonitor.RecordServerCount(TypeHTTP, r.Method, preAPI)
+		MetricMonitor.RecordServerHandlerSecondsContext(r.Context(), TypeHTTP, r.Method, state.Status(), preAPI, cost.Seconds())
+		endServerSpan(span, r.Method, preAPI, state.Status())
+		if accessLog := HttpMonitor.getAccessLog(); accessLog != nil {
+			accessLog.record(r, preAPI, state.Status(), cost, 0, state.Written())
+		}
+		HttpMonitor.recordSLO(preAPI, state.Status(), cost)
+		return
+	}
+	if limiter != nil {
+		// handler panic时也要归还并发额度
+		defer func() { limiter.release(time.Since(now)) }()
+	}
+	if timeout := HttpMonitor.getHandlerTimeout(); timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	capture := HttpMonitor.requestCapture()
+	body := &captureBody{ReadCloser: r.Body, max: capture.MaxBodyBytes, capture: capture.capturesContentType(r.Header.Get("Content-Type"))}
+	r.Body = body
+
+	finish := func() {
+		cost := time.Since(now)
+		status := state.Status()
+		// 请求结束前ctx不会被net/http取消，这里取消说明客户端断开或者超时
+		reason, abortStatus := abortReason(r.Context())
+		if reason != "" {
+			status = abortStatus
+		}
+		// 路由匹配在handler里完成，之后才能拿到路由模板
+		api := state.Route()
+		if api == "" {
+			api = HttpMonitor.apiLabel(r, status)
+		}
+		endServerSpan(span, r.Method, api, status)
+		MetricMonitor.RecordServerCount(TypeHTTP, r.Method, api)
+		MetricMonitor.RecordServerHandlerSecondsContext(r.Context(), TypeHTTP, r.Method, status, api, cost.Seconds())
+		reqSize := r.ContentLength
+		if reqSize < 0 {
+			reqSize = body.read
+		}
+		MetricMonitor.RecordServerRequestSize(TypeHTTP, r.Method, api, reqSize)
+		MetricMonitor.RecordServerResponseSize(TypeHTTP, r.Method, api, state.Written())
+		if accessLog := HttpMonitor.getAccessLog(); accessLog != nil {
+			accessLog.record(r, api, status, cost, reqSize, state.Written())
+		}
+		if reason != "" {
+			serverAbortedCounter.WithLabelValues(TypeHTTP, api, reason).Inc()
+		}
+		// 客户端主动断开不算失败请求，是否计入SLO由SLO.CountClientClosed决定
+		HttpMonitor.recordSLO(api, status, cost)
+		// 只有失败或者慢请求才记录请求内容
+		switch {
+		case reason != "":
+			// 中断的请求不记录请求内容
+		case status >= http.StatusBadRequest:
+			log.WithFields(withRequestFields(r.Context(), log.Fields{
+				"request": capture.dump(r, body),
+				"code":    status,
+				Cost:      cost.Milliseconds(),
+			})).Warn("request fail ")
+		case cost >= capture.SlowThreshold:
+			log.WithFields(withRequestFields(r.Context(), log.Fields{
+				"request":  capture.dump(r, body),
+				"code":     status,
+				Cost:       cost.Milliseconds(),
+				MetricType: "slowLog",
+			})).Warn("request slow")
+		}
+	}
+	if recoverPanic {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// 客户端断开时net/http用ErrAbortHandler中断响应，交给net/http处理
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			api := state.Route()
+			if api == "" {
+				api = HttpMonitor.apiLabel(r, http.StatusInternalServerError)
+			}
+			recordPanic(r, api, p)
+			if !state.Committed() {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			finish()
+		}()
+	}
+	next(r)
+	finish()
+}
+
+// RouteMiddleware 和MetricMiddleware加RecoveryMiddleware的效果一样，route 在handler执行之后返回框架的路由模板，
+// 供chi这类基于net/http的路由使用
+func RouteMiddleware(route func(r *http.Request) string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw := &responseWriter{ResponseWriter: w}
+			state := &routeState{responseWriter: rw, route: route}
+			ServeInstrumented(rw, r, state, func(r *http.Request) {
+				state.r = r
+				next.ServeHTTP(rw.wrap(), r)
+			})
+		})
+	}
+}
+
+type routeState struct {
+	*responseWriter
+	route func(r *http.Request) string
+	r     *http.Request
+}
+
+func (s *routeState) Route() string {
+	if s.r == nil {
+		return ""
+	}
+	return s.route(s.r)
+}
@@ -0,0 +1,99 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestAbortedRequests(t *testing.T) {
+	var buf bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+
+	handler := MetricMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cancel, ok := r.Context().Value(ctxKeyTestCancel{}).(context.CancelFunc); ok {
+			// 模拟客户端断开
+			cancel()
+		} else {
+			<-r.Context().Done()
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, ctxKeyTestCancel{}, cancel)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/abort/1", nil).WithContext(ctx))
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/abort/2", nil).WithContext(ctx))
+
+	for status, reason := range map[string]string{"499": abortClientClosed, "504": abortTimeout} {
+		if v, _ := gatherValue(t, serverHandleHistogram, "server_handle_seconds", map[string]string{"api": "/abort/:id", "status": status}); v != 1 {
+			t.Errorf("server_handle_seconds{status=%s} = %v, want 1", status, v)
+		}
+		if v, _ := gatherValue(t, serverAbortedCounter, "server_aborted_requests_total", map[string]string{"api": "/abort/:id", "reason": reason}); v != 1 {
+			t.Errorf("server_aborted_requests_total{reason=%s} = %v, want 1", reason, v)
+		}
+	}
+	if _, ok := gatherValue(t, serverHandleHistogram, "server_handle_seconds", map[string]string{"api": "/abort/:id", "status": "200"}); ok {
+		t.Error("aborted request recorded with the handler status")
+	}
+	if strings.Contains(buf.String(), "request fail") {
+		t.Errorf("aborted request logged as failure: %s", buf.String())
+	}
+}
+
+type ctxKeyTestCancel struct{}
+
+func TestHandlerTimeoutAndClientClosedSLO(t *testing.T) {
+	HttpMonitor.SetHandlerTimeout(5 * time.Millisecond)
+	defer HttpMonitor.SetHandlerTimeout(0)
+	for _, slo := range []SLO{
+		{Name: "abort-default", Route: "/timeout/:id", LatencyThreshold: time.Second, Target: 0.9},
+		{Name: "abort-counted", Route: "/timeout/:id", LatencyThreshold: time.Second, Target: 0.9, CountClientClosed: true},
+	} {
+		if err := HttpMonitor.AddSLO(slo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		HttpMonitor.mu.Lock()
+		HttpMonitor.slos = nil
+		HttpMonitor.mu.Unlock()
+	}()
+
+	handler := MetricMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cancel, ok := r.Context().Value(ctxKeyTestCancel{}).(context.CancelFunc); ok {
+			cancel()
+			return
+		}
+		<-r.Context().Done()
+	}))
+	// 请求本身没有deadline，由SetHandlerTimeout超时
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/timeout/1", nil))
+	if v, _ := gatherValue(t, serverAbortedCounter, "server_aborted_requests_total", map[string]string{"api": "/timeout/:id", "reason": abortTimeout}); v != 1 {
+		t.Errorf("server_aborted_requests_total{reason=timeout} = %v, want 1", v)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, ctxKeyTestCancel{}, cancel)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/timeout/2", nil).WithContext(ctx))
+
+	// 504算不达标，499只有CountClientClosed的SLO计入并且算不达标
+	for name, want := range map[string][2]float64{"abort-default": {1, 0}, "abort-counted": {2, 0}} {
+		total, _ := gatherValue(t, sloEventCounter, "slo_events_total", map[string]string{"slo": name})
+		good, _ := gatherValue(t, sloGoodEventCounter, "slo_good_events_total", map[string]string{"slo": name})
+		if total != want[0] || good != want[1] {
+			t.Errorf("%s events = %v good = %v, want %v", name, total, good, want)
+		}
+	}
+}
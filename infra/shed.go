@@ -0,0 +1,144 @@
+package infra
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func init() {
+	MetricsReg.MustRegister(httpInflightGauge, httpShedCounter, httpConcurrencyLimitGauge)
+}
+
+var (
+	httpInflightGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_inflight_requests",
+	}, []string{"api"})
+
+	httpShedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_shed_requests_total",
+	}, []string{"api"})
+
+	httpConcurrencyLimitGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_concurrency_limit",
+	})
+)
+
+// LoadSheddingConfig 自适应并发限制的配置，使用AIMD算法：
+// 请求耗时不超过TargetLatency且并发接近上限时限制加1，超过时限制乘以Backoff
+type LoadSheddingConfig struct {
+	InitialLimit  int
+	MinLimit      int
+	MaxLimit      int
+	TargetLatency time.Duration
+	Backoff       float64
+}
+
+type aimdLimiter struct {
+	mu       sync.Mutex
+	cfg      LoadSheddingConfig
+	limit    float64
+	inflight int
+}
+
+func newAIMDLimiter(cfg LoadSheddingConfig) *aimdLimiter {
+	if cfg.MinLimit <= 0 {
+		cfg.MinLimit = 10
+	}
+	if cfg.MaxLimit <= 0 {
+		cfg.MaxLimit = 1000
+	}
+	if cfg.InitialLimit <= 0 {
+		cfg.InitialLimit = 100
+	}
+	if cfg.TargetLatency <= 0 {
+		cfg.TargetLatency = 500 * time.Millisecond
+	}
+	if cfg.Backoff <= 0 || cfg.Backoff >= 1 {
+		cfg.Backoff = 0.9
+	}
+	l := &aimdLimiter{cfg: cfg}
+	l.setLimit(float64(cfg.InitialLimit))
+	return l
+}
+
+func (l *aimdLimiter) setLimit(limit float64) {
+	l.limit = math.Max(float64(l.cfg.MinLimit), math.Min(float64(l.cfg.MaxLimit), limit))
+	httpConcurrencyLimitGauge.Set(math.Floor(l.limit))
+}
+
+func (l *aimdLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight >= int(l.limit) {
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+func (l *aimdLimiter) release(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inflight := l.inflight
+	l.inflight--
+	if latency > l.cfg.TargetLatency {
+		l.setLimit(l.limit * l.cfg.Backoff)
+	} else if float64(inflight)*2 >= l.limit {
+		// 并发没用到一半时不扩大限制，避免空闲时限制无限增长
+		l.setLimit(l.limit + 1)
+	}
+}
+
+func (l *aimdLimiter) currentLimit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// EnableLoadShedding 开启自适应并发限制，超过限制的请求直接返回503
+func (h *httpMonitor) EnableLoadShedding(cfg LoadSheddingConfig) {
+	l := newAIMDLimiter(cfg)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.limiter = l
+}
+
+// ConcurrencyLimit 返回当前的并发限制，没有开启时返回0
+func (h *httpMonitor) ConcurrencyLimit() int {
+	l := h.loadShedder()
+	if l == nil {
+		return 0
+	}
+	return l.currentLimit()
+}
+
+func (h *httpMonitor) loadShedder() *aimdLimiter {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.limiter
+}
+
+// SetServeMux 设置请求使用的ServeMux，用于在handler执行前得到路由模板
+func (h *httpMonitor) SetServeMux(mux *http.ServeMux) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.mux = mux
+}
+
+// preRouteLabel 在handler执行前得到api标签，供在途请求和限流指标使用。
+// 没有SetServeMux时handler执行前拿不到路由模板，统一为other，不能用path，否则扫描器的随机path会让基数爆炸
+func (h *httpMonitor) preRouteLabel(r *http.Request) string {
+	h.mu.RLock()
+	mux := h.mux
+	h.mu.RUnlock()
+	if mux == nil {
+		return OtherAPI
+	}
+	if _, pattern := mux.Handler(r); pattern != "" {
+		return stripPatternMethod(pattern)
+	}
+	return OtherAPI
+}
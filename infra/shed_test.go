@@ -0,0 +1,138 @@
+package infra
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAIMDLimiter(t *testing.T) {
+	l := newAIMDLimiter(LoadSheddingConfig{InitialLimit: 2, MinLimit: 1, MaxLimit: 4, TargetLatency: 100 * time.Millisecond, Backoff: 0.5})
+	if !l.acquire() || !l.acquire() || l.acquire() {
+		t.Fatal("limiter should admit exactly 2 requests")
+	}
+	l.release(time.Millisecond)
+	if got := l.currentLimit(); got != 3 {
+		t.Fatalf("limit after fast release = %d, want 3", got)
+	}
+	l.release(time.Second)
+	if got := l.currentLimit(); got != 1 {
+		t.Fatalf("limit after slow release = %d, want 1", got)
+	}
+	for i := 0; i < 10; i++ {
+		l.release(time.Second)
+		l.inflight++
+	}
+	if got := l.currentLimit(); got != 1 {
+		t.Fatalf("limit below min: %d", got)
+	}
+}
+
+func TestLoadSheddingRejectsWith503(t *testing.T) {
+	mux := http.NewServeMux()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	mux.HandleFunc("/shed/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	HttpMonitor.SetServeMux(mux)
+	HttpMonitor.EnableLoadShedding(LoadSheddingConfig{InitialLimit: 1, MinLimit: 1, MaxLimit: 1})
+	defer func() {
+		HttpMonitor.mu.Lock()
+		HttpMonitor.mux, HttpMonitor.limiter = nil, nil
+		HttpMonitor.mu.Unlock()
+	}()
+	handler := MetricMiddleware(mux)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/shed/slow", nil))
+	}()
+	<-started
+	if v, _ := gatherValue(t, httpInflightGauge, "http_inflight_requests", map[string]string{"api": "/shed/slow"}); v != 1 {
+		t.Errorf("inflight = %v, want 1", v)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/shed/slow", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("shed response = %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	close(release)
+	wg.Wait()
+
+	if v, _ := gatherValue(t, httpShedCounter, "http_shed_requests_total", map[string]string{"api": "/shed/slow"}); v != 1 {
+		t.Errorf("http_shed_requests_total = %v, want 1", v)
+	}
+	if v, _ := gatherValue(t, httpInflightGauge, "http_inflight_requests", map[string]string{"api": "/shed/slow"}); v != 0 {
+		t.Errorf("inflight after finish = %v, want 0", v)
+	}
+	if got := HttpMonitor.ConcurrencyLimit(); got != 1 {
+		t.Errorf("ConcurrencyLimit = %d, want 1", got)
+	}
+}
+
+func TestPreRouteLabelWithoutMux(t *testing.T) {
+	HttpMonitor.EnableLoadShedding(LoadSheddingConfig{InitialLimit: 1, MinLimit: 1, MaxLimit: 1})
+	HttpMonitor.SetMaxNormalizedPaths(5)
+	defer HttpMonitor.SetMaxNormalizedPaths(0)
+	defer func() {
+		HttpMonitor.mu.Lock()
+		HttpMonitor.limiter = nil
+		HttpMonitor.mu.Unlock()
+	}()
+	apis := make(map[string]bool)
+	handler := MetricMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 在handler里再发一个请求，让它被限流
+		rec := httptest.NewRecorder()
+		MetricMiddleware(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, r.URL.Path+"/inner", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("inner request = %d, want 503", rec.Code)
+		}
+	}))
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(httpInflightGauge, httpShedCounter, serverHandleHistogram)
+	for i := 0; i < 20; i++ {
+		path := fmt.Sprintf("/wp-admin/%x.php", rand.Int63())
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "api" {
+					apis[l.GetValue()] = true
+				}
+			}
+		}
+	}
+	paths := 0
+	for api := range apis {
+		// 限流的内层请求只能是other
+		if strings.HasSuffix(api, "/inner") {
+			t.Errorf("pre-route metrics labelled with raw path %q", api)
+		}
+		if strings.HasPrefix(api, "/wp-admin/") {
+			paths++
+		}
+	}
+	// 外层请求在handler执行后按path归一化，超过上限的path是other
+	if paths != 5 {
+		t.Errorf("%d normalized path labels, want 5", paths)
+	}
+	if v, _ := gatherValue(t, httpShedCounter, "http_shed_requests_total", map[string]string{"api": OtherAPI}); v < 20 {
+		t.Errorf("http_shed_requests_total{api=other} = %v, want >= 20", v)
+	}
+}
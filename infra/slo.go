@@ -0,0 +1,202 @@
+package infra
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	MetricsReg.MustRegister(sloEventCounter, sloGoodEventCounter, sloBurnRates)
+}
+
+var (
+	sloEventCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "slo_events_total",
+	}, []string{"slo"})
+
+	sloGoodEventCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "slo_good_events_total",
+	}, []string{"slo"})
+
+	sloBurnRates = &sloCollector{
+		desc: prometheus.NewDesc("slo_burn_rate", "error budget burn rate of the slo in the window", []string{"slo", "window"}, nil),
+	}
+
+	sloName = regexp.MustCompile(`^[a-zA-Z0-9_:-]+$`)
+)
+
+// 多窗口多燃烧率告警用到的窗口，最长6小时
+var sloWindows = []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour}
+
+const sloBucketCount = 6 * 60
+
+// SLO 按路由模板声明的服务目标，耗时不超过LatencyThreshold且没有返回5xx的请求算作达标
+type SLO struct {
+	Name             string
+	Route            string
+	LatencyThreshold time.Duration
+	// 达标比例，比如 0.999
+	Target float64
+	// 客户端断开(499)的请求默认不计入SLO，为true时算作不达标，客户端往往是等得太久才断开
+	CountClientClosed bool
+}
+
+type sloBucket struct {
+	minute int64
+	good   float64
+	total  float64
+}
+
+type sloTracker struct {
+	SLO
+	mu      sync.Mutex
+	buckets [sloBucketCount]sloBucket
+}
+
+// AddSLO 声明一个SLO，MetricMiddleware会按路由模板统计达标和总的请求数，
+// 客户端断开的499请求默认不计入，需要计入时设置SLO.CountClientClosed
+func (h *httpMonitor) AddSLO(slo SLO) error {
+	if !sloName.MatchString(slo.Name) {
+		return fmt.Errorf("invalid slo name %q", slo.Name)
+	}
+	if slo.Target <= 0 || slo.Target >= 1 {
+		return fmt.Errorf("slo %s target must be between 0 and 1", slo.Name)
+	}
+	if slo.LatencyThreshold <= 0 {
+		return fmt.Errorf("slo %s latency threshold must be positive", slo.Name)
+	}
+	tracker := &sloTracker{SLO: slo}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, t := range h.slos {
+		if t.Name == slo.Name {
+			return fmt.Errorf("slo %s already exists", slo.Name)
+		}
+	}
+	h.slos = append(h.slos, tracker)
+	return nil
+}
+
+func (h *httpMonitor) getSLOs() []*sloTracker {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.slos
+}
+
+// recordSLO 统计请求对路由上的SLO是否达标
+func (h *httpMonitor) recordSLO(api string, status int, cost time.Duration) {
+	now := time.Now()
+	for _, t := range h.getSLOs() {
+		if t.Route != api {
+			continue
+		}
+		good := status < 500 && cost <= t.LatencyThreshold
+		if status == StatusClientClosedRequest {
+			if !t.CountClientClosed {
+				continue
+			}
+			good = false
+		}
+		sloEventCounter.WithLabelValues(t.Name).Inc()
+		if good {
+			sloGoodEventCounter.WithLabelValues(t.Name).Inc()
+		}
+		t.add(now, good)
+	}
+}
+
+func (t *sloTracker) add(now time.Time, good bool) {
+	minute := now.Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[minute%sloBucketCount]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if good {
+		b.good++
+	}
+}
+
+// burnRate 返回窗口内的错误率和错误预算的比值，1表示刚好在SLO周期内用完错误预算
+func (t *sloTracker) burnRate(now time.Time, window time.Duration) float64 {
+	minute := now.Unix() / 60
+	from := minute - int64(window/time.Minute)
+	var good, total float64
+	t.mu.Lock()
+	for _, b := range t.buckets {
+		if b.minute > from && b.minute <= minute {
+			good += b.good
+			total += b.total
+		}
+	}
+	t.mu.Unlock()
+	if total == 0 {
+		return 0
+	}
+	return (1 - good/total) / (1 - t.Target)
+}
+
+type sloCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c *sloCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *sloCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, t := range HttpMonitor.getSLOs() {
+		for _, w := range sloWindows {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, t.burnRate(now, w), t.Name, promDuration(w))
+		}
+	}
+}
+
+// promDuration 把窗口转成prometheus的时间格式，比如 5m、1h
+func promDuration(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return fmt.Sprintf("%dm", d/time.Minute)
+}
+
+// WriteSLORules 生成SLO的prometheus记录规则和告警规则，
+// 告警使用多窗口多燃烧率：1h和5m都超过14.4倍时page，6h和30m都超过6倍时ticket
+func (h *httpMonitor) WriteSLORules(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("groups:\n")
+	for _, t := range h.getSLOs() {
+		fmt.Fprintf(&b, "  - name: slo-%s\n", t.Name)
+		b.WriteString("    rules:\n")
+		for _, window := range sloWindows {
+			d := promDuration(window)
+			fmt.Fprintf(&b, "      - record: slo:burn_rate:%s\n", d)
+			fmt.Fprintf(&b, "        expr: '(1 - sum(rate(slo_good_events_total{slo=\"%s\"}[%s])) / sum(rate(slo_events_total{slo=\"%s\"}[%s]))) / %.6g'\n", t.Name, d, t.Name, d, 1-t.Target)
+			fmt.Fprintf(&b, "        labels:\n          slo: %s\n", t.Name)
+		}
+		for _, alert := range []struct {
+			name, severity string
+			long, short    string
+			factor         float64
+		}{
+			{"SLOBurnRatePage", "page", "1h", "5m", 14.4},
+			{"SLOBurnRateTicket", "ticket", "6h", "30m", 6},
+		} {
+			fmt.Fprintf(&b, "      - alert: %s\n", alert.name)
+			fmt.Fprintf(&b, "        expr: 'slo:burn_rate:%s{slo=\"%s\"} > %g and slo:burn_rate:%s{slo=\"%s\"} > %g'\n", alert.long, t.Name, alert.factor, alert.short, t.Name, alert.factor)
+			fmt.Fprintf(&b, "        labels:\n          severity: %s\n          slo: %s\n", alert.severity, t.Name)
+			fmt.Fprintf(&b, "        annotations:\n          summary: 'slo %s (%s) is burning error budget %gx faster than allowed'\n", t.Name, strings.ReplaceAll(t.Route, "'", "''"), alert.factor)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,80 @@
+package infra
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSLOTracking(t *testing.T) {
+	if err := HttpMonitor.AddSLO(SLO{Name: "slo-test", Route: "/slo/:id", LatencyThreshold: 50 * time.Millisecond, Target: 0.9}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		HttpMonitor.mu.Lock()
+		HttpMonitor.slos = nil
+		HttpMonitor.mu.Unlock()
+	}()
+	if err := HttpMonitor.AddSLO(SLO{Name: "slo-test", Route: "/x", LatencyThreshold: time.Second, Target: 0.9}); err == nil {
+		t.Error("duplicate slo accepted")
+	}
+	if err := HttpMonitor.AddSLO(SLO{Name: "bad name", Route: "/x", LatencyThreshold: time.Second, Target: 0.9}); err == nil {
+		t.Error("invalid slo name accepted")
+	}
+
+	handler := MetricMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slo/1", nil))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slo/2?fail=1", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/other/1", nil))
+
+	if v, _ := gatherValue(t, sloEventCounter, "slo_events_total", map[string]string{"slo": "slo-test"}); v != 4 {
+		t.Errorf("slo_events_total = %v, want 4", v)
+	}
+	if v, _ := gatherValue(t, sloGoodEventCounter, "slo_good_events_total", map[string]string{"slo": "slo-test"}); v != 3 {
+		t.Errorf("slo_good_events_total = %v, want 3", v)
+	}
+	// 错误率25%，错误预算10%，燃烧率2.5
+	for _, window := range []string{"5m", "6h"} {
+		if v, _ := gatherValue(t, sloBurnRates, "slo_burn_rate", map[string]string{"slo": "slo-test", "window": window}); math.Abs(v-2.5) > 1e-9 {
+			t.Errorf("slo_burn_rate{window=%s} = %v, want 2.5", window, v)
+		}
+	}
+
+	var rules strings.Builder
+	if err := HttpMonitor.WriteSLORules(&rules); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"  - name: slo-slo-test\n",
+		"      - record: slo:burn_rate:1h\n",
+		`expr: '(1 - sum(rate(slo_good_events_total{slo="slo-test"}[30m])) / sum(rate(slo_events_total{slo="slo-test"}[30m]))) / 0.1'`,
+		`expr: 'slo:burn_rate:1h{slo="slo-test"} > 14.4 and slo:burn_rate:5m{slo="slo-test"} > 14.4'`,
+		"      - alert: SLOBurnRateTicket\n",
+	} {
+		if !strings.Contains(rules.String(), want) {
+			t.Errorf("rules missing %q:\n%s", want, rules.String())
+		}
+	}
+}
+
+func TestSLOBurnRateWindow(t *testing.T) {
+	tracker := &sloTracker{SLO: SLO{Target: 0.99}}
+	now := time.Now()
+	tracker.add(now.Add(-2*time.Hour), false)
+	tracker.add(now, true)
+	if v := tracker.burnRate(now, time.Hour); v != 0 {
+		t.Errorf("1h burn rate = %v, want 0", v)
+	}
+	if v := tracker.burnRate(now, 6*time.Hour); math.Abs(v-50) > 1e-9 {
+		t.Errorf("6h burn rate = %v, want 50", v)
+	}
+}
@@ -87,19 +87,20 @@ func (conn *Conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx
 		if err != nil {
 			return tx, err
 		}
-		return &DriveTx{Tx: tx, start: time.Now()}, nil
+		return &DriveTx{Tx: tx, start: time.Now(), ctx: ctx}, nil
 	}
 	tx, err := conn.Conn.Begin()
 	if err != nil {
 		return tx, err
 	}
-	return &DriveTx{Tx: tx, start: time.Now()}, nil
+	return &DriveTx{Tx: tx, start: time.Now(), ctx: ctx}, nil
 }
 
 type DriveTx struct {
 	driver.Tx
 	start time.Time
 	cost  int64
+	ctx   context.Context
 }
 
 func getStack() *stack {
@@ -115,7 +116,7 @@ func (d *DriveTx) Commit() error {
 			MetricType: "longTx",
 			Stack:      fmt.Sprintf("%+v", getStack()),
 		}
-		log.WithFields(data).Errorf("mysqlongTxlog ")
+		log.WithFields(withRequestFields(d.ctx, data)).Errorf("mysqlongTxlog ")
 	}
 	return err
 }
@@ -129,7 +130,7 @@ func (d *DriveTx) Rollback() error {
 			MetricType: "longTx",
 			Stack:      fmt.Sprintf("%+v", getStack()),
 		}
-		log.WithFields(data).Errorf("mysqlongTxlog ")
+		log.WithFields(withRequestFields(d.ctx, data)).Errorf("mysqlongTxlog ")
 	}
 	return err
 }
@@ -35,9 +35,14 @@ func (s *sqlMonitor) parseTable(sql string) ([]string, SqlOp, error) {
 		return nil, "", err
 	}
 	tables, op := getTable(stmt)
+	// 没有调用SetFixName时表名原样返回
+	fix := s.FixTbName
+	if fix == nil {
+		fix = defaultFixName
+	}
 	res := make([]string, 0, len(tables))
 	for _, tbname := range tables {
-		res = append(res, s.FixTbName(tbname))
+		res = append(res, fix(tbname))
 	}
 	return res, op, nil
 }
@@ -168,6 +168,14 @@ func callers() *stack {
 	return &st
 }
 
+// callersDepth 和callers一样，但可以指定跳过的层数和栈的深度，panic时需要更完整的栈
+func callersDepth(skip int, depth int) *stack {
+	pcs := make([]uintptr, depth)
+	n := runtime.Callers(skip, pcs)
+	var st stack = pcs[0:n]
+	return &st
+}
+
 // funcname removes the path prefix component of a function's name reported by func.Name().
 func funcname(name string) string {
 	i := strings.LastIndex(name, "/")
@@ -0,0 +1,225 @@
+package infra
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultTenantTopN = 50
+
+func init() {
+	MetricsReg.MustRegister(tenantUsage)
+}
+
+// UIDExtractor 从请求中解析租户或者用户id，解析不到时返回空
+type UIDExtractor func(r *http.Request) string
+
+// HeaderUID 从header中取uid，比如 X-User-Id
+func HeaderUID(name string) UIDExtractor {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// CookieUID 从cookie中取uid
+func CookieUID(name string) UIDExtractor {
+	return func(r *http.Request) string {
+		c, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	}
+}
+
+// JWTClaimUID 从 "Authorization: Bearer <jwt>" 的payload中取claim，
+// 这里不校验签名，只用于监控归属，鉴权仍然要由业务完成
+func JWTClaimUID(claim string) UIDExtractor {
+	return func(r *http.Request) string {
+		auth := r.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+			return ""
+		}
+		parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+		if len(parts) != 3 {
+			return ""
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err != nil {
+			return ""
+		}
+		claims := map[string]interface{}{}
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			return ""
+		}
+		switch v := claims[claim].(type) {
+		case string:
+			return v
+		case float64:
+			return fmt.Sprintf("%.0f", v)
+		}
+		return ""
+	}
+}
+
+// SetUIDExtractor 设置解析uid的方法，按顺序取第一个非空的结果
+func (h *httpMonitor) SetUIDExtractor(extractors ...UIDExtractor) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.uidExtractors = extractors
+}
+
+func (h *httpMonitor) extractUID(r *http.Request) string {
+	h.mu.RLock()
+	extractors := h.uidExtractors
+	h.mu.RUnlock()
+	for _, extract := range extractors {
+		if uid := extract(r); uid != "" {
+			return uid
+		}
+	}
+	return ""
+}
+
+// SetRequestUID 记录当前请求的用户，http、sql和redis日志都会带上uid字段，同时计入租户用量
+func SetRequestUID(ctx context.Context, uid string) {
+	state := requestStateFrom(ctx)
+	if state == nil || uid == "" {
+		return
+	}
+	state.mu.Lock()
+	first := state.uid == ""
+	state.uid = uid
+	state.mu.Unlock()
+	if first {
+		tenantUsage.addRequest(uid)
+	}
+}
+
+func requestUID(ctx context.Context) string {
+	state := requestStateFrom(ctx)
+	if state == nil {
+		return ""
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.uid
+}
+
+// SetTenantTopN 设置租户用量最多统计的租户数，0表示关闭
+func (m *metricMonitor) SetTenantTopN(n int) {
+	tenantUsage.mu.Lock()
+	defer tenantUsage.mu.Unlock()
+	tenantUsage.capacity = n
+	for len(tenantUsage.tenants) > n {
+		tenantUsage.evictLocked()
+	}
+}
+
+type tenantStats struct {
+	// space-saving的估计值，只用于排名
+	estimate float64
+	// 进入top N之后实际的请求数，导出的counter只增不减
+	requests     float64
+	dbSeconds    float64
+	redisSeconds float64
+}
+
+// tenantCollector 用space-saving算法统计请求数最多的N个租户，
+// 满了之后新租户替换估计值最小的租户并继承它的估计值用于排名，
+// 导出的是进入top N之后实际的计数，被替换的租户的序列消失，再次进入时从0开始，rate()按counter重置处理
+type tenantCollector struct {
+	mu       sync.Mutex
+	capacity int
+	tenants  map[string]*tenantStats
+
+	requestsDesc *prometheus.Desc
+	dbDesc       *prometheus.Desc
+	redisDesc    *prometheus.Desc
+}
+
+var tenantUsage = newTenantCollector(defaultTenantTopN)
+
+func newTenantCollector(capacity int) *tenantCollector {
+	return &tenantCollector{
+		capacity:     capacity,
+		tenants:      make(map[string]*tenantStats),
+		requestsDesc: prometheus.NewDesc("tenant_requests_total", "requests of the top tenants", []string{"uid"}, nil),
+		dbDesc:       prometheus.NewDesc("tenant_db_seconds_total", "mysql time of the top tenants", []string{"uid"}, nil),
+		redisDesc:    prometheus.NewDesc("tenant_redis_seconds_total", "redis time of the top tenants", []string{"uid"}, nil),
+	}
+}
+
+func (c *tenantCollector) addRequest(uid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capacity <= 0 {
+		return
+	}
+	stats, ok := c.tenants[uid]
+	if !ok {
+		var inherited float64
+		if len(c.tenants) >= c.capacity {
+			inherited = c.evictLocked()
+		}
+		stats = &tenantStats{estimate: inherited}
+		c.tenants[uid] = stats
+	}
+	stats.estimate++
+	stats.requests++
+}
+
+// evictLocked 去掉估计值最小的租户，返回它的估计值
+func (c *tenantCollector) evictLocked() float64 {
+	minUID, minEstimate := "", 0.0
+	for uid, stats := range c.tenants {
+		if minUID == "" || stats.estimate < minEstimate {
+			minUID, minEstimate = uid, stats.estimate
+		}
+	}
+	delete(c.tenants, minUID)
+	return minEstimate
+}
+
+// addDuration 只统计已经在top N里的租户
+func (c *tenantCollector) addDuration(ctx context.Context, metricType string, seconds float64) {
+	uid := requestUID(ctx)
+	if uid == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats, ok := c.tenants[uid]
+	if !ok {
+		return
+	}
+	switch metricType {
+	case TypeMySQL:
+		stats.dbSeconds += seconds
+	case TypeRedis:
+		stats.redisSeconds += seconds
+	}
+}
+
+func (c *tenantCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.requestsDesc
+	ch <- c.dbDesc
+	ch <- c.redisDesc
+}
+
+func (c *tenantCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for uid, stats := range c.tenants {
+		ch <- prometheus.MustNewConstMetric(c.requestsDesc, prometheus.CounterValue, stats.requests, uid)
+		ch <- prometheus.MustNewConstMetric(c.dbDesc, prometheus.CounterValue, stats.dbSeconds, uid)
+		ch <- prometheus.MustNewConstMetric(c.redisDesc, prometheus.CounterValue, stats.redisSeconds, uid)
+	}
+}
@@ -0,0 +1,140 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestUIDExtractors(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice","tenant":1001}`))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer header."+payload+".sig")
+	req.AddCookie(&http.Cookie{Name: "uid", Value: "bob"})
+
+	if got := JWTClaimUID("tenant")(req); got != "1001" {
+		t.Errorf("JWTClaimUID(tenant) = %q", got)
+	}
+	if got := JWTClaimUID("sub")(req); got != "alice" {
+		t.Errorf("JWTClaimUID(sub) = %q", got)
+	}
+	if got := CookieUID("uid")(req); got != "bob" {
+		t.Errorf("CookieUID = %q", got)
+	}
+	if got := HeaderUID("X-User-Id")(req); got != "" {
+		t.Errorf("HeaderUID = %q, want empty", got)
+	}
+}
+
+func TestTenantAttribution(t *testing.T) {
+	server := newFakeRedis(t, func(args []string) string { return "$-1\r\n" })
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	RedisMonitor.AddRedisHook(client, "tenant")
+	RedisMonitor.AddMonitorKey("tenantkey")
+
+	HttpMonitor.SetUIDExtractor(HeaderUID("X-User-Id"), CookieUID("uid"))
+	defer HttpMonitor.SetUIDExtractor()
+	var buf bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+	RedisMonitor.SetKeySlowThreshold("tenantkey", -1)
+
+	handler := MetricMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RedisMonitor.WithContext(r.Context(), client).Get("tenantkey:1")
+		hook := &HookDb{dbName: "tenant"}
+		ctx, _ := hook.Before(r.Context(), "select 1 from t where id = 1")
+		hook.After(ctx, "select 1 from t where id = 1")
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/tenant", nil)
+	req.Header.Set("X-User-Id", "acme")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.Contains(buf.String(), `"uid":"acme"`) || !strings.Contains(buf.String(), "redisslowlog") {
+		t.Errorf("redis log missing uid: %s", buf.String())
+	}
+	if v, _ := gatherValue(t, tenantUsage, "tenant_requests_total", map[string]string{"uid": "acme"}); v != 1 {
+		t.Errorf("tenant_requests_total = %v, want 1", v)
+	}
+	if v, ok := gatherValue(t, tenantUsage, "tenant_redis_seconds_total", map[string]string{"uid": "acme"}); !ok || v <= 0 {
+		t.Errorf("tenant_redis_seconds_total = %v, want > 0", v)
+	}
+	if _, ok := gatherValue(t, tenantUsage, "tenant_db_seconds_total", map[string]string{"uid": "acme"}); !ok {
+		t.Error("tenant_db_seconds_total missing")
+	}
+}
+
+func TestTenantTopNCapped(t *testing.T) {
+	c := newTenantCollector(2)
+	for i := 0; i < 5; i++ {
+		c.addRequest("big")
+	}
+	c.addRequest("small")
+	c.addRequest("new")
+	if len(c.tenants) != 2 || c.tenants["big"] == nil || c.tenants["new"] == nil {
+		t.Fatalf("tenants = %v", c.tenants)
+	}
+	// 新租户继承被替换租户的估计值用于排名，导出的请求数从进入top N开始计
+	if got := c.tenants["new"].estimate; got != 2 {
+		t.Errorf("new tenant estimate = %v, want 2", got)
+	}
+	if got := c.tenants["new"].requests; got != 1 {
+		t.Errorf("new tenant requests = %v, want 1", got)
+	}
+	if v, _ := gatherValue(t, c, "tenant_requests_total", map[string]string{"uid": "new"}); v != 1 {
+		t.Errorf("exported new tenant requests = %v, want 1", v)
+	}
+	c.addDuration(context.Background(), TypeMySQL, 1)
+	if c.tenants["big"].dbSeconds != 0 {
+		t.Error("duration without uid attributed")
+	}
+}
+
+func TestTenantRedisSkipsBlockingPipeline(t *testing.T) {
+	server := newFakeRedis(t, func(args []string) string {
+		if args[0] == "blpop" {
+			time.Sleep(10 * time.Millisecond)
+			return "*-1\r\n"
+		}
+		return "$-1\r\n"
+	})
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	RedisMonitor.AddRedisHook(client, "tenantpipe")
+
+	ctx := withRequestState(context.Background())
+	SetRequestUID(ctx, "pipe-tenant")
+	tenantUsage.addRequest("pipe-tenant")
+	c := RedisMonitor.WithContext(ctx, client)
+	redisSeconds := func() float64 {
+		tenantUsage.mu.Lock()
+		defer tenantUsage.mu.Unlock()
+		return tenantUsage.tenants["pipe-tenant"].redisSeconds
+	}
+
+	c.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.Get("a")
+		pipe.BLPop(time.Second, "queue")
+		return nil
+	})
+	if v := redisSeconds(); v != 0 {
+		t.Errorf("blocking pipeline added %v redis seconds", v)
+	}
+	c.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.Get("a")
+		pipe.Get("b")
+		return nil
+	})
+	if v := redisSeconds(); v <= 0 {
+		t.Errorf("pipeline redis seconds = %v, want > 0", v)
+	}
+}
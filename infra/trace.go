@@ -0,0 +1,114 @@
+package infra
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	TraceIDField = "trace_id"
+	SpanIDField  = "span_id"
+
+	traceparentHeader = "traceparent"
+)
+
+type ctxKeyTrace struct{}
+
+// TraceContext 是W3C traceparent中的链路信息
+type TraceContext struct {
+	TraceID string
+	SpanID  string
+	// 上游的span，请求没有带traceparent时为空
+	ParentSpanID string
+	Sampled      bool
+}
+
+// Traceparent 返回传给下游的traceparent头
+func (t TraceContext) Traceparent() string {
+	flags := "00"
+	if t.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", t.TraceID, t.SpanID, flags)
+}
+
+// ContextWithTrace 把链路信息放入ctx，日志和exemplar会从ctx里取trace_id
+func ContextWithTrace(ctx context.Context, t TraceContext) context.Context {
+	return context.WithValue(ctx, ctxKeyTrace{}, t)
+}
+
+// TraceFromContext 返回ctx中的链路信息
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	if ctx == nil {
+		return TraceContext{}, false
+	}
+	t, ok := ctx.Value(ctxKeyTrace{}).(TraceContext)
+	return t, ok
+}
+
+// traceFromRequest 从traceparent头继承trace_id
+func traceFromRequest(r *http.Request) TraceContext {
+	return traceFromTraceparent(r.Header.Get(traceparentHeader))
+}
+
+// traceFromTraceparent traceparent为空或者不合法时生成新的trace_id，每次都生成新的span_id
+func traceFromTraceparent(h string) TraceContext {
+	t := TraceContext{SpanID: newSpanID(), Sampled: true}
+	if traceID, parentID, sampled, ok := parseTraceparent(h); ok {
+		t.TraceID, t.ParentSpanID, t.Sampled = traceID, parentID, sampled
+		return t
+	}
+	t.TraceID = newTraceID()
+	return t
+}
+
+// parseTraceparent 解析 version-traceid-parentid-flags 格式的traceparent
+func parseTraceparent(h string) (traceID string, parentID string, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", false, false
+	}
+	// version 00 只能有4段，更高的版本允许后面有扩展字段
+	if parts[0] == "00" && len(parts) != 4 {
+		return "", "", false, false
+	}
+	traceID, parentID, flags := parts[1], parts[2], parts[3]
+	if !isLowerHex(parts[0]) || len(traceID) != 32 || !isLowerHex(traceID) || isZeroID(traceID) ||
+		len(parentID) != 16 || !isLowerHex(parentID) || isZeroID(parentID) ||
+		len(flags) != 2 || !isLowerHex(flags) {
+		return "", "", false, false
+	}
+	b, _ := hex.DecodeString(flags)
+	return traceID, parentID, b[0]&0x01 == 1, true
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isZeroID(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+func newTraceID() string {
+	return randomHex(16)
+}
+
+func newSpanID() string {
+	return randomHex(8)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
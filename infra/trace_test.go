@@ -0,0 +1,95 @@
+package infra
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	cases := []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+	for _, c := range cases {
+		_, _, sampled, ok := parseTraceparent(c.header)
+		if ok != c.ok || sampled != c.sampled {
+			t.Errorf("parseTraceparent(%q) = sampled %v ok %v, want %v %v", c.header, sampled, ok, c.sampled, c.ok)
+		}
+	}
+}
+
+func TestMiddlewarePropagatesTrace(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	var buf bytes.Buffer
+	out := log.StandardLogger().Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+
+	var got TraceContext
+	handler := MetricMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = TraceFromContext(r.Context())
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/trace/1", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got.TraceID != traceID || got.ParentSpanID != "00f067aa0ba902b7" || len(got.SpanID) != 16 || got.SpanID == got.ParentSpanID {
+		t.Fatalf("unexpected trace context: %+v", got)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(buf.String())), &entry); err != nil {
+		t.Fatalf("request fail log is not json: %v %q", err, buf.String())
+	}
+	if entry[TraceIDField] != traceID || entry[SpanIDField] != got.SpanID {
+		t.Errorf("log missing trace fields: %v", entry)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(serverHandleHistogram)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, m := range families[0].GetMetric() {
+		for _, b := range m.GetHistogram().GetBucket() {
+			if e := b.GetExemplar(); e != nil && len(e.GetLabel()) == 1 && e.GetLabel()[0].GetValue() == traceID {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Error("server_handle_seconds has no exemplar with the trace id")
+	}
+}
+
+func TestMiddlewareGeneratesTrace(t *testing.T) {
+	var got TraceContext
+	handler := MetricMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = TraceFromContext(r.Context())
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/trace/new", nil)
+	req.Header.Set("traceparent", "garbage")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if _, _, _, ok := parseTraceparent(got.Traceparent()); !ok || got.ParentSpanID != "" {
+		t.Fatalf("generated trace is invalid: %+v", got)
+	}
+}
@@ -1,16 +1,57 @@
+// 启用go1.22的ServeMux路由模板，MetricMiddleware用匹配到的模板作为api标签
+//
+//go:debug httpmuxgo121=0
 package main
 
 import (
 	"easymonitor/infra"
+	"flag"
 	"github.com/go-redis/redis"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 )
 
+var sloRules = flag.String("slo-rules", "", "生成SLO的prometheus规则文件后退出，比如 -slo-rules slo_rules.yml")
+
 func main() {
+	flag.Parse()
+	if err := infra.HttpMonitor.AddSLO(infra.SLO{
+		Name:             "webapp-root",
+		Route:            "/",
+		LatencyThreshold: 300 * time.Millisecond,
+		Target:           0.99,
+	}); err != nil {
+		log.WithError(err).Error("add slo fail")
+	}
+	if *sloRules != "" {
+		f, err := os.Create(*sloRules)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		if err := infra.HttpMonitor.WriteSLORules(f); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// 批处理接口会超过10s，native histogram让面板上的分位数不依赖桶的划分
+	infra.MetricMonitor.SetServerBuckets(infra.TypeHTTP, []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60})
+	infra.MetricMonitor.EnableNativeHistograms(1.1)
+	// 配置了collector地址才上报链路，比如 OTLP_ENDPOINT=mynode:4318
+	if endpoint := os.Getenv("OTLP_ENDPOINT"); endpoint != "" {
+		if err := infra.TraceMonitor.Enable(infra.TracingConfig{
+			ServiceName: "webapp",
+			Endpoint:    endpoint,
+			Insecure:    true,
+			SampleRatio: 0.1,
+		}); err != nil {
+			log.WithError(err).Error("enable tracing fail")
+		}
+	}
 	infra.SqlMonitor.InitHookDb([]*infra.DbInfo{
 		{
 			MaxConn: 10,
@@ -33,6 +74,7 @@ func main() {
 	})
 	infra.RedisMonitor.AddRedisHook(client, "rediscache")
 	infra.RedisMonitor.AddMonitorKey("name")
+	infra.RedisMonitor.StartServerCollector(15 * time.Second)
 	go func() {
 		for {
 			time.Sleep(3 * time.Second)
@@ -42,11 +84,17 @@ func main() {
 		}
 
 	}()
+	if err := infra.HttpMonitor.EnableAccessLog(infra.AccessLogConfig{SampleRatio: 0.1}); err != nil {
+		log.WithError(err).Error("enable access log fail")
+	}
+	infra.HttpMonitor.SetUIDExtractor(infra.HeaderUID("X-User-Id"), infra.JWTClaimUID("sub"))
 	router := http.NewServeMux()
+	// 在途请求和限流指标在路由之前就需要路由模板
+	infra.HttpMonitor.SetServeMux(router)
 	// 创建一个处理程序函数
 	handler := http.HandlerFunc(handleRequest)
 	// 使用中间件包装处理程序函数
-	middleware := infra.MetricMiddleware(handler)
+	middleware := infra.MetricMiddleware(infra.RecoveryMiddleware(handler))
 	// 注册处理程序和中间件到路由器
 	router.Handle("/", middleware)
 	log.Infof("webapp start")